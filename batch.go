@@ -0,0 +1,175 @@
+package gravity
+
+import (
+	"ohalloc/treap"
+	"sort"
+	"sync/atomic"
+)
+
+// WriteBatch writes all the data into a single contiguous region of memory and returns their keys in
+// the same order. Either all the data is written or none is. Like the writes merging free spaces, it excludes
+// other writes but not reads unless the memory has to be grown
+func (g *Gravity) WriteBatch(data [][]byte) ([]uint64, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	g.RLock()
+	// keys are issued upfront as the length of compact headers depends on them
+	keys := make([]uint64, len(data))
+	for i := range data {
+		keys[i] = g.getKey()
+	}
+	g.placing.Lock()
+	g.reclaim()
+	err := g.writeBatchAny(keys, data, false)
+	g.placing.Unlock()
+	g.RUnlock()
+
+	if err == NotEnoughSpace && g.opts.grow != nil {
+		g.Lock()
+		defer g.Unlock()
+		g.reclaim()
+		err = g.writeBatchAny(keys, data, true)
+	}
+	if err != nil {
+		return nil, g.failed(err)
+	}
+	return keys, nil
+}
+
+// writeBatchAny writes the batch to the first region with enough space. The memory is grown if none has and
+// grow is set, which requires the write lock
+func (g *Gravity) writeBatchAny(keys []uint64, data [][]byte, grow bool) error {
+	for _, r := range g.all() {
+		err := r.writeBatch(keys, data)
+		if err == nil {
+			for _, k := range keys {
+				g.refer(r, k)
+			}
+			return nil
+		}
+		if err != NotEnoughSpace {
+			return err
+		}
+	}
+	if !grow {
+		return NotEnoughSpace
+	}
+	totalLen := uint64(0)
+	for i, d := range data {
+		totalLen += g.recordLen(uint64(len(d)), keys[i])
+	}
+	if err := g.grow(totalLen); err != nil {
+		return err
+	}
+	return g.writeBatch(keys, data)
+}
+
+// writeBatch writes the data for the keys contiguously in the region
+func (g *Gravity) writeBatch(keys []uint64, data [][]byte) error {
+	totalLen := uint64(0)
+	for i, d := range data {
+		totalLen += g.recordLen(uint64(len(d)), keys[i])
+	}
+	fs, err := g.allocate(totalLen)
+	if err != nil {
+		return err
+	}
+	defer g.release(fs)
+
+	start := fs.Start
+	for i, d := range data {
+		if err = g.place(fs, keys[i], d); err != nil {
+			// roll back the records placed so far
+			for _, k := range keys[:i] {
+				g.vmap.loadAndDelete(k)
+			}
+			fs.Start = start
+			g.markFree(fs)
+			return err
+		}
+	}
+	return nil
+}
+
+// FreeBatch frees the memory held by the data of all the keys. The freed records are coalesced and
+// returned to the pool at once. Either all the keys are freed or, if any of the keys is not found
+// (or repeated), none is. Other writes and frees are excluded while the keys are checked and freed
+func (g *Gravity) FreeBatch(keys []uint64) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	g.RLock()
+	defer g.RUnlock()
+	g.placing.Lock()
+	defer g.placing.Unlock()
+
+	// keys grouped by the region holding them, the Gravity itself being the first
+	byRegion := make([][]uint64, len(g.regions)+1)
+	seen := make(map[uint64]struct{}, len(keys))
+	for _, k := range keys {
+		pos, err := g.loadFromVPos(k)
+		if err != nil {
+			return err
+		}
+		if _, ok := seen[k]; ok {
+			return WrongReadPosition
+		}
+		seen[k] = struct{}{}
+		i := 0
+		if isRegionRef(pos) {
+			i = int(pos&^regionRefFlag) + 1
+		}
+		byRegion[i] = append(byRegion[i], k)
+	}
+	for i, r := range g.all() {
+		if len(byRegion[i]) == 0 {
+			continue
+		}
+		if r != g {
+			for _, k := range byRegion[i] {
+				g.vmap.loadAndDelete(k)
+			}
+		}
+		if err := r.freeKeys(byRegion[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// freeKeys frees the records of the keys held by the region, coalescing adjacent records
+func (g *Gravity) freeKeys(keys []uint64) error {
+	positions := make([]uint64, 0, len(keys))
+	for _, k := range keys {
+		pos, _ := g.vmap.load(k)
+		if isSlabLocator(pos) {
+			g.vmap.loadAndDelete(k)
+			if err := g.slabFree(pos); err != nil {
+				return err
+			}
+			continue
+		}
+		positions = append(positions, pos)
+	}
+	sort.Slice(positions, func(i, j int) bool {
+		return positions[i] < positions[j]
+	})
+
+	var fss []*treap.FreeSpace
+	for _, pos := range positions {
+		h, _ := g.recordAt(pos)
+		g.vmap.loadAndDelete(h.key)
+		atomic.AddUint64(&g.stats.frees, 1)
+		end := pos + g.recordLen(h.dl, h.key) - 1
+		if n := len(fss); n > 0 && fss[n-1].End+1 == pos {
+			fss[n-1].End = end
+			continue
+		}
+		fss = append(fss, &treap.FreeSpace{Start: pos, End: end})
+	}
+	for _, fs := range fss {
+		g.markFree(fs)
+	}
+	return g.fsm.addAll(fss)
+}
@@ -0,0 +1,209 @@
+package gravity
+
+import (
+	"errors"
+	"ohalloc/treap"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultBufferSize is the size of the chunks claimed by allocation buffers by default
+const defaultBufferSize = uint64(16 << 10)
+
+// bufferKeys is the number of keys an allocation buffer takes at once
+const bufferKeys = uint64(64)
+
+var BufferClosed = errors.New("buffer closed")
+
+// Buffer is an allocation buffer of a single writer, for ex. one per worker goroutine. It claims a chunk of
+// free space along with a block of keys and writes the records fitting in the chunk by bumping its start,
+// holding only the lock of the buffer. Records larger than the chunk and slab records are written like Write.
+// The unused part of the chunk is returned to the pool on Flush and Close, and whenever the Gravity needs to
+// walk or move records or grow
+type Buffer struct {
+	g      *Gravity
+	size   uint64           // size of the chunks claimed
+	mu     sync.Mutex       // guards the fields below
+	r      *Gravity         // region of the chunk
+	chunk  *treap.FreeSpace // unused part of the chunk, nil if none is claimed
+	next   uint64           // next key of the block
+	last   uint64           // last key of the block, next > last once the block is used up
+	writes uint64           // records written to the chunk and not yet counted in the stats of r
+	closed bool
+}
+
+// NewBuffer returns an allocation buffer claiming chunks of size bytes, a size of 0 uses 16 KiB. The size is
+// rounded up to the alignment of the records so that the free space around the chunks stays aligned
+func (g *Gravity) NewBuffer(size uint64) *Buffer {
+	if size == 0 {
+		size = defaultBufferSize
+	}
+	b := &Buffer{g: g, size: alignUp(size, g.align), next: 1}
+	g.bufMu.Lock()
+	defer g.bufMu.Unlock()
+	if g.buffers == nil {
+		g.buffers = make(map[*Buffer]struct{})
+	}
+	g.buffers[b] = struct{}{}
+	return b
+}
+
+// Write adds data to the memory like Gravity.Write and returns its key
+func (b *Buffer) Write(data []byte) (uint64, error) {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return 0, BufferClosed
+	}
+	k, ok := b.bump(data)
+	b.mu.Unlock()
+	if ok {
+		return k, nil
+	}
+	k, err := b.g.writeWith(b, data)
+	return k, b.g.failed(err)
+}
+
+// bump writes the record to the chunk with the next key of the block if both are left. The chunk is only
+// claimed under the read lock and placing, and is reclaimed before the memory is walked, moved or grown, so
+// the lock of the buffer is enough to write to it. The caller must hold the lock of the buffer
+func (b *Buffer) bump(data []byte) (uint64, bool) {
+	g := b.g
+	dl := uint64(len(data))
+	if b.chunk == nil || b.next > b.last || g.slab.classOf(dl) >= 0 ||
+		b.chunk.Size() < g.recordLen(dl, b.next) {
+		return 0, false
+	}
+	k := b.next
+	if err := b.r.put(b.chunk, k, data); err != nil {
+		return 0, false
+	}
+	b.next++
+	b.writes++
+	g.refer(b.r, k)
+	return k, true
+}
+
+// Flush returns the unused part of the chunk to the pool
+func (b *Buffer) Flush() error {
+	b.g.RLock()
+	defer b.g.RUnlock()
+	b.g.placing.RLock()
+	defer b.g.placing.RUnlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.flush()
+}
+
+// Close flushes the buffer and releases it, it can't be written to afterwards
+func (b *Buffer) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return BufferClosed
+	}
+	b.closed = true
+	b.mu.Unlock()
+	err := b.Flush()
+	b.g.bufMu.Lock()
+	delete(b.g.buffers, b)
+	b.g.bufMu.Unlock()
+	return err
+}
+
+// write places the record in the chunk, claiming a new chunk if the data doesn't fit the remaining part,
+// and takes a new block of keys for the following writes if the block is used up. The caller must hold the
+// read lock. needsMerge is returned if the record isn't written
+func (b *Buffer) write(k uint64, data []byte) error {
+	g := b.g
+	dl := uint64(len(data))
+	n := g.recordLen(dl, k)
+	if g.slab.classOf(dl) >= 0 || n > b.size {
+		return needsMerge
+	}
+	g.placing.RLock()
+	defer g.placing.RUnlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.next > b.last {
+		b.next = g.getKeys(bufferKeys)
+		b.last = b.next + bufferKeys - 1
+	}
+	if b.chunk == nil || b.chunk.Size() < n {
+		if err := b.flush(); err != nil {
+			return err
+		}
+		if !b.claim() {
+			return needsMerge
+		}
+	}
+	if err := b.r.put(b.chunk, k, data); err != nil {
+		return err
+	}
+	b.writes++
+	g.refer(b.r, k)
+	return nil
+}
+
+// claim extracts a chunk from the first region with a free space large enough and returns the rest of the
+// free space to the pool
+func (b *Buffer) claim() bool {
+	for _, r := range b.g.all() {
+		fs, err := r.fsm.extractFit(b.size)
+		if err != nil {
+			continue
+		}
+		chunk := &treap.FreeSpace{Start: fs.Start, End: fs.Start + b.size - 1}
+		fs.Start += b.size
+		r.markFree(fs)
+		r.markFree(chunk)
+		r.release(fs)
+		b.r, b.chunk = r, chunk
+		return true
+	}
+	return false
+}
+
+// flush returns the unused part of the chunk to the pool and counts the records written to it. The caller
+// must hold the lock of the buffer
+func (b *Buffer) flush() error {
+	c := b.chunk
+	if c == nil {
+		return nil
+	}
+	b.chunk = nil
+	atomic.AddUint64(&b.r.stats.writes, b.writes)
+	b.writes = 0
+	if c.Size() == 0 {
+		return nil
+	}
+	return b.r.fsm.add(c)
+}
+
+// reclaim returns the chunks of all the allocation buffers to the pool so that records can be walked, moved or
+// migrated. The caller must hold the write lock or placing
+func (g *Gravity) reclaim() {
+	g.bufMu.Lock()
+	defer g.bufMu.Unlock()
+	for b := range g.buffers {
+		b.mu.Lock()
+		_ = b.flush()
+		b.mu.Unlock()
+	}
+}
+
+// buffered returns the unused space of the chunks the allocation buffers claimed in the region r, along with
+// the records written to them that aren't counted in the stats of r yet
+func (g *Gravity) buffered(r *Gravity) (bytes uint64, writes uint64) {
+	g.bufMu.Lock()
+	defer g.bufMu.Unlock()
+	for b := range g.buffers {
+		b.mu.Lock()
+		if b.r == r && b.chunk != nil {
+			bytes += b.chunk.Size()
+			writes += b.writes
+		}
+		b.mu.Unlock()
+	}
+	return bytes, writes
+}
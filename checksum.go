@@ -0,0 +1,128 @@
+package gravity
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+)
+
+// checksumLen is the length of the CRC32C stored after the key when checksums are enabled
+const checksumLen = uint64(4)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	ChecksumMismatch = errors.New("checksum mismatch")
+	KeyMismatch      = errors.New("key mismatch")
+)
+
+// CorruptionError is returned when the record stored for a key doesn't match its header
+type CorruptionError struct {
+	Key uint64 // Key used to locate the record
+	Pos uint64 // Position of the record in memory
+	Err error  // One of ChecksumMismatch, KeyMismatch or WrongReadPosition
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("corrupted record (key: %v, pos: %v): %v", e.Key, e.Pos, e.Err)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return e.Err
+}
+
+// ScrubError lists all the corrupted records found by Scrub
+type ScrubError struct {
+	Records []*CorruptionError // sorted by key
+}
+
+func (e *ScrubError) Error() string {
+	return fmt.Sprintf("found %v corrupted records", len(e.Records))
+}
+
+// Keys returns the keys of the corrupted records
+func (e *ScrubError) Keys() []uint64 {
+	keys := make([]uint64, len(e.Records))
+	for i, r := range e.Records {
+		keys[i] = r.Key
+	}
+	return keys
+}
+
+// checksum computes the CRC32C of the record's headers (excluding the checksum itself) and data
+func (g *Gravity) checksum(pos uint64, h recordHeader) uint32 {
+	c := crc32.Update(0, castagnoli, g.mem[pos:pos+h.hl-checksumLen])
+	return crc32.Update(c, castagnoli, g.mem[pos+h.hl:pos+h.hl+h.dl])
+}
+
+// putChecksum stores the checksum of the record at pos if checksums are enabled
+func (g *Gravity) putChecksum(pos uint64, h recordHeader) {
+	if !g.opts.checksum {
+		return
+	}
+	cpos := pos + h.hl - checksumLen
+	binary.LittleEndian.PutUint32(g.mem[cpos:cpos+checksumLen], g.checksum(pos, h))
+}
+
+// verifyRecord checks that the record at pos belongs to the key and matches its checksum (if enabled)
+// and returns the header of the record
+func (g *Gravity) verifyRecord(pos uint64, key uint64) (recordHeader, error) {
+	h, ok := g.recordAt(pos)
+	if !ok {
+		return h, &CorruptionError{Key: key, Pos: pos, Err: WrongReadPosition}
+	}
+	if h.key != key {
+		return h, &CorruptionError{Key: key, Pos: pos, Err: KeyMismatch}
+	}
+	if g.opts.checksum {
+		cpos := pos + h.hl - checksumLen
+		if binary.LittleEndian.Uint32(g.mem[cpos:cpos+checksumLen]) != g.checksum(pos, h) {
+			return h, &CorruptionError{Key: key, Pos: pos, Err: ChecksumMismatch}
+		}
+	}
+	return h, nil
+}
+
+// Scrub verifies every live record against its key and checksum (if enabled).
+// A *ScrubError listing the corrupted records is returned if any are found
+func (g *Gravity) Scrub() error {
+	g.RLock()
+	defer g.RUnlock()
+	g.placing.Lock()
+	defer g.placing.Unlock()
+	var corrupted []*CorruptionError
+	for _, r := range g.all() {
+		corrupted = append(corrupted, r.scrub()...)
+	}
+	if len(corrupted) == 0 {
+		return nil
+	}
+	sort.Slice(corrupted, func(i, j int) bool {
+		return corrupted[i].Key < corrupted[j].Key
+	})
+	return &ScrubError{Records: corrupted}
+}
+
+// scrub returns the corrupted records of the region
+func (g *Gravity) scrub() []*CorruptionError {
+	var corrupted []*CorruptionError
+	g.vmap.iterate(func(key uint64, pos uint64) bool {
+		var err error
+		switch {
+		case isRegionRef(pos):
+		case isSlabLocator(pos):
+			_, err = g.slabData(key, pos)
+		case g.slab.isPage(key):
+			err = g.verifyPage(pos, key)
+		default:
+			_, err = g.verifyRecord(pos, key)
+		}
+		if cerr, ok := err.(*CorruptionError); ok {
+			corrupted = append(corrupted, cerr)
+		}
+		return true
+	})
+	return corrupted
+}
@@ -0,0 +1,117 @@
+package gravity
+
+import "ohalloc/treap"
+
+// Compact packs all the records towards the start of the memory leaving a single free space at the end
+// of every region. The spans of open reservations stay put, the records are packed between them instead.
+// Reads carry on while the records are moved, while writes, frees and updates wait for the compaction to
+// finish. Use CompactStep to compact in bounded steps
+func (g *Gravity) Compact() {
+	g.RLock()
+	defer g.RUnlock()
+	g.placing.Lock()
+	defer g.placing.Unlock()
+	g.reclaim()
+	for _, r := range g.all() {
+		r.compact()
+	}
+}
+
+func (g *Gravity) compact() {
+	fss := g.fsm.extractAll()
+	if len(fss) == 0 {
+		return
+	}
+	// records are packed towards the start of every stretch of memory between reserved spans, which stay put
+	var merged []*treap.FreeSpace
+	from := 0
+	for i, fs := range fss {
+		end := g.size
+		if i+1 < len(fss) {
+			end = fss[i+1].Start
+		}
+		wall, walled := g.wallWithin(fs.End+1, end)
+		if !walled && i+1 < len(fss) {
+			continue
+		}
+		if !walled {
+			wall = g.size
+		}
+		stretch := fss[from : i+1 : i+1]
+		if fs.End+1 != wall {
+			// an empty free space at the wall moves the records following the last free space
+			stretch = append(stretch, &treap.FreeSpace{Start: wall, End: wall - 1})
+		}
+		fs := g.merge(stretch)
+		g.markFree(fs)
+		merged = append(merged, fs)
+		from = i + 1
+	}
+	last := len(merged) - 1
+	_ = g.fsm.addAll(merged[:last])
+	g.release(merged[last])
+}
+
+// CompactStep moves the records following the first free space towards the start of the memory, moving at
+// most maxBytes (but at least a single record) per call. It returns the bytes moved and whether the memory
+// is fully compacted, so that it can be called repeatedly (for ex. from a background goroutine) without holding
+// the write lock for long
+func (g *Gravity) CompactStep(maxBytes uint64) (moved uint64, done bool) {
+	g.RLock()
+	defer g.RUnlock()
+	g.placing.Lock()
+	defer g.placing.Unlock()
+	g.reclaim()
+
+	// regions are compacted one after the other
+	all := g.all()
+	for i, r := range all {
+		if r.compacted() {
+			continue
+		}
+		moved, done = r.compactStep(maxBytes)
+		for _, next := range all[i+1:] {
+			done = done && next.compacted()
+		}
+		return moved, done
+	}
+	return 0, true
+}
+
+// compacted returns whether the region has no free space other than at its end or before reserved spans
+func (g *Gravity) compacted() bool {
+	return g.fsm.first(g.movable) == nil
+}
+
+// movable returns whether records follow the free space, which can be moved into it
+func (g *Gravity) movable(fs *treap.FreeSpace) bool {
+	return fs.End != g.size-1 && !g.walled(fs.End+1)
+}
+
+func (g *Gravity) compactStep(maxBytes uint64) (moved uint64, done bool) {
+	fs := g.fsm.extractFirst(g.movable)
+	if fs == nil {
+		return 0, true
+	}
+
+	// collect the records following the free space that fit within maxBytes
+	start := fs.End + 1
+	end := start
+	for end < g.size {
+		s, err := g.spanAt(end)
+		if err != nil || s.free || (end > start && end-start+s.size > maxBytes) {
+			break
+		}
+		end += s.size
+	}
+	moved = end - start
+	g.readAndShift(start, end, fs.Start, fs.Start+moved)
+
+	// the free space moves to the right and is merged with the following free space if adjacent
+	fs.Start += moved
+	fs.End += moved
+	g.markFree(fs)
+	g.release(fs)
+
+	return moved, g.compacted()
+}
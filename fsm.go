@@ -1,8 +1,10 @@
 package gravity
 
 import (
+	"container/list"
 	"errors"
 	"log"
+	"math/bits"
 	"ohalloc/treap"
 	"sync"
 	"sync/atomic"
@@ -10,21 +12,40 @@ import (
 
 var (
 	NotEnoughSpace = errors.New("not enough space")
+	needsMerge     = errors.New("no single free space fits")
 	illegalPoolPut = errors.New("pool put called without pool get")
 )
 
-
 // freeSpaceManager is a treap with freeSpace's start as key and the freeSpace's interval size as heap score
 type freeSpaceManager struct {
 	sync.Mutex
 	pcond               *sync.Cond // condition to notify freespaces returned to the pool
 	root                *treap.Node
 	totalFreeSpace      uint64
-	extractedFreeSpaces int32     // number of freespaces currently being extracted from the pool
+	extractedFreeSpaces int32      // number of freespaces currently being extracted from the pool
+	waiters             *list.List // queue of spaceWaiter waiting for free space
+	placement           PlacementStrategy
+	// free space of the manager and the regions reporting to it, stored atomically whenever it changes so that
+	// it can be read without waiting for the free spaces being extracted
+	estimate uint64
+
+	// The waiters of a Gravity with additional regions are queued in the manager of its first region (queue),
+	// to which the managers of the other regions report their free space
+	queue      *freeSpaceManager
+	region     int      // index of the region in queue.regionFree
+	regionFree []uint64 // free space last reported by the other regions
+}
+
+// spaceWaiter waits till the total free space can satisfy its size
+type spaceWaiter struct {
+	size  uint64
+	ready chan struct{} // notified when the waiter is at the head of the queue and its size can be satisfied
+	elem  *list.Element
 }
 
 func newFSM() *freeSpaceManager {
-	t := &freeSpaceManager{}
+	t := &freeSpaceManager{waiters: list.New(), placement: GravityFit{}}
+	t.queue = t
 	t.pcond = sync.NewCond(&t.Mutex)
 	return t
 }
@@ -41,6 +62,7 @@ func (t *freeSpaceManager) add(fs *treap.FreeSpace) error {
 	oldRoot := t.root
 	t.root = treap.Insert(t.root, nn)
 	t.totalFreeSpace += fs.Size()
+	t.notifyWaiter(true)
 	if oldRoot != t.root {
 		// Broadcast is still called to all goroutines waiting to check if the root has been updated
 		t.pcond.Broadcast()
@@ -48,12 +70,34 @@ func (t *freeSpaceManager) add(fs *treap.FreeSpace) error {
 	return nil
 }
 
+// addAll inserts or merges all the provided free spaces under a single lock
+func (t *freeSpaceManager) addAll(fss []*treap.FreeSpace) error {
+	for _, fs := range fss {
+		if fs.Size() <= 0 {
+			return errors.New("empty freespace")
+		}
+	}
+	t.Lock()
+	defer t.Unlock()
+	oldRoot := t.root
+	for _, fs := range fss {
+		nn := treap.NodePool.Get()
+		nn.Fs = fs
+		t.root = treap.Insert(t.root, nn)
+		t.totalFreeSpace += fs.Size()
+	}
+	t.notifyWaiter(true)
+	if oldRoot != t.root {
+		t.pcond.Broadcast()
+	}
+	return nil
+}
+
 func (t *freeSpaceManager) poolExtract(size uint64) ([]*treap.FreeSpace, error) {
 	t.Lock()
 
-	expectedNodeSize := size
 	// wait till the root size is not met and there are in-use free space
-	for (t.root == nil || t.root.Size() < expectedNodeSize) && t.extractedFreeSpaces > 0 {
+	for (t.root == nil || t.root.Size() < size) && t.extractedFreeSpaces > 0 {
 		t.pcond.Wait()
 	}
 	// At this point totalFreeSpace contains all the items
@@ -61,23 +105,89 @@ func (t *freeSpaceManager) poolExtract(size uint64) ([]*treap.FreeSpace, error)
 		t.Unlock()
 		return nil, NotEnoughSpace
 	}
-	if t.root.Size() < expectedNodeSize {
-		expectedNodeSize = 0
-	}
 
-	// Get max gravity node
-	node := treap.GreatestGravityNode(t.root, expectedNodeSize)
+	// select the free space to start from and its neighbours to merge as per the placement strategy
+	node := t.placement.Select(t.root, size)
 	defer treap.NodePool.Put(node)
-	fss, nr, extractedSize := treap.GetFittingNeighbours(t.root, node, size)
+	fss, nr, extractedSize := t.placement.Neighbours(t.root, node, size)
 	// update the root
 	t.root = nr
 	t.totalFreeSpace -= extractedSize
 	// inform that a fs has been pulled out
 	t.extractedFreeSpaces += 1
+	t.notifyWaiter(false)
 	t.Unlock()
 	return fss, nil
 }
 
+// extractFit extracts the free space selected by the placement strategy if it satisfies size on its own, so
+// that no records have to be moved to use it. needsMerge is returned otherwise.
+// The free space must be returned with poolPut
+func (t *freeSpaceManager) extractFit(size uint64) (*treap.FreeSpace, error) {
+	t.Lock()
+	defer t.Unlock()
+	if t.root == nil || t.root.Size() < size {
+		return nil, needsMerge
+	}
+	node := t.placement.Select(t.root, size)
+	if node.Size() < size {
+		return nil, needsMerge
+	}
+	fs := node.Fs
+	t.root, _ = treap.Remove(t.root, node)
+	t.totalFreeSpace -= fs.Size()
+	t.extractedFreeSpaces += 1
+	t.notifyWaiter(false)
+	return fs, nil
+}
+
+// extractNeighbours removes the free spaces immediately after and before the interval [start, end] from
+// the pool if together with the interval they span at least size bytes.
+// The free space after the interval is preferred and a neighbour is only extracted when required
+func (t *freeSpaceManager) extractNeighbours(start, end, size uint64) (prev, next *treap.FreeSpace, ok bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	var pn, nn *treap.Node
+	if n := treap.Floor(t.root, end+1); n != nil && n.Fs.Start == end+1 {
+		nn = n
+	}
+	if n := treap.Floor(t.root, start); start > 0 && n != nil && n.Fs.End == start-1 {
+		pn = n
+	}
+
+	avail := end - start + 1
+	if avail < size && nn != nil {
+		avail += nn.Size()
+	} else {
+		nn = nil
+	}
+	if avail < size && pn != nil {
+		avail += pn.Size()
+	} else {
+		pn = nil
+	}
+	if avail < size {
+		return nil, nil, false
+	}
+
+	for _, n := range []*treap.Node{pn, nn} {
+		if n == nil {
+			continue
+		}
+		fs := n.Fs
+		t.root, _ = treap.Remove(t.root, n)
+		t.totalFreeSpace -= fs.Size()
+		if n == pn {
+			prev = fs
+		} else {
+			next = fs
+		}
+	}
+	t.notifyWaiter(false)
+	return prev, next, true
+}
+
 func (t *freeSpaceManager) poolPut(fs *treap.FreeSpace) error {
 	t.Lock()
 	defer t.Unlock()
@@ -93,9 +203,202 @@ func (t *freeSpaceManager) poolPut(fs *treap.FreeSpace) error {
 	nn.Fs = fs
 	t.root = treap.Insert(t.root, nn)
 	atomic.AddUint64(&t.totalFreeSpace, fs.Size())
+	t.notifyWaiter(true)
 	return nil
 }
 
+// putBack returns the free spaces extracted with poolExtract to the pool without merging them
+func (t *freeSpaceManager) putBack(fss []*treap.FreeSpace) {
+	t.Lock()
+	defer t.Unlock()
+	t.extractedFreeSpaces -= 1
+	for _, fs := range fss {
+		nn := treap.NodePool.Get()
+		nn.Fs = fs
+		t.root = treap.Insert(t.root, nn)
+		t.totalFreeSpace += fs.Size()
+	}
+	t.notifyWaiter(false)
+	t.pcond.Broadcast()
+}
+
+// extractAll extracts all the free spaces from the pool sorted by their start.
+// The free spaces must be merged to a single free space and returned with poolPut
+func (t *freeSpaceManager) extractAll() []*treap.FreeSpace {
+	t.Lock()
+	defer t.Unlock()
+	t.waitForExtractedFreeSpaces()
+	var fss []*treap.FreeSpace
+	treap.Walk(t.root, func(fs *treap.FreeSpace) bool {
+		fss = append(fss, fs)
+		return true
+	})
+	if len(fss) == 0 {
+		return nil
+	}
+	t.root = nil
+	t.totalFreeSpace = 0
+	t.extractedFreeSpaces += 1
+	t.notifyWaiter(false)
+	return fss
+}
+
+// reset replaces all the free spaces in the pool with fs
+func (t *freeSpaceManager) reset(fs *treap.FreeSpace) {
+	t.Lock()
+	defer t.Unlock()
+	t.waitForExtractedFreeSpaces()
+	t.root = nil
+	t.totalFreeSpace = 0
+	if fs.Size() > 0 {
+		nn := treap.NodePool.Get()
+		nn.Fs = fs
+		t.root = treap.Insert(t.root, nn)
+		t.totalFreeSpace = fs.Size()
+	}
+	t.notifyWaiter(true)
+}
+
+// truncate removes the interval (end, oldEnd] from the pool, which must be part of the free space ending at
+// oldEnd, and returns the remaining part of that free space
+func (t *freeSpaceManager) truncate(oldEnd, end uint64) (*treap.FreeSpace, bool) {
+	t.Lock()
+	defer t.Unlock()
+	t.waitForExtractedFreeSpaces()
+	n := treap.Floor(t.root, oldEnd)
+	if n == nil || n.Fs.End != oldEnd || n.Fs.Start > end+1 {
+		return nil, false
+	}
+	fs := *n.Fs
+	t.root, _ = treap.Remove(t.root, n)
+	t.totalFreeSpace -= fs.Size()
+	fs.End = end
+	if fs.Size() > 0 {
+		nn := treap.NodePool.Get()
+		nn.Fs = &fs
+		t.root = treap.Insert(t.root, nn)
+		t.totalFreeSpace += fs.Size()
+	}
+	t.notifyWaiter(false)
+	return &fs, true
+}
+
+// extractFirst extracts the free space with the lowest start for which ok returns true from the pool.
+// It must be returned with poolPut
+func (t *freeSpaceManager) extractFirst(ok func(fs *treap.FreeSpace) bool) *treap.FreeSpace {
+	t.Lock()
+	defer t.Unlock()
+	t.waitForExtractedFreeSpaces()
+	fn := t.firstNode(ok)
+	if fn == nil {
+		return nil
+	}
+	fs := fn.Fs
+	t.root, _ = treap.Remove(t.root, fn)
+	t.totalFreeSpace -= fs.Size()
+	t.extractedFreeSpaces += 1
+	t.notifyWaiter(false)
+	return fs
+}
+
+// first returns a copy of the free space with the lowest start for which ok returns true
+func (t *freeSpaceManager) first(ok func(fs *treap.FreeSpace) bool) *treap.FreeSpace {
+	t.Lock()
+	defer t.Unlock()
+	fn := t.firstNode(ok)
+	if fn == nil {
+		return nil
+	}
+	fs := *fn.Fs
+	return &fs
+}
+
+func (t *freeSpaceManager) firstNode(ok func(fs *treap.FreeSpace) bool) *treap.Node {
+	for n := treap.Min(t.root); n != nil; n = n.Next() {
+		if ok(n.Fs) {
+			return n
+		}
+	}
+	return nil
+}
+
+// enqueue adds a waiter for size bytes of free space to the end of the queue
+func (t *freeSpaceManager) enqueue(size uint64) *spaceWaiter {
+	t.Lock()
+	defer t.Unlock()
+	w := &spaceWaiter{size: size, ready: make(chan struct{}, 1)}
+	w.elem = t.waiters.PushBack(w)
+	t.notifyWaiter(true)
+	return w
+}
+
+// dequeue removes the waiter from the queue and lets the next waiter proceed
+func (t *freeSpaceManager) dequeue(w *spaceWaiter) {
+	t.Lock()
+	defer t.Unlock()
+	t.waiters.Remove(w.elem)
+	t.notifyWaiter(true)
+}
+
+// notifyWaiter publishes the free space and, if it grew (or the queue changed), notifies the waiter at the head
+// of the queue if there's enough free space for it. It's called whenever the free space changes. A waiter isn't
+// notified when free spaces are extracted or put back unused, so that a write failing without any change to the
+// free space (for ex. when the free spaces are split by a reservation) doesn't retry in a loop. Waiters behind
+// the head are not notified so that they are served in FIFO order
+func (t *freeSpaceManager) notifyWaiter(grown bool) {
+	if t.queue != t {
+		t.queue.reportFree(t.region, t.totalFreeSpace, grown)
+		return
+	}
+	estimate := t.totalFreeSpace
+	for _, free := range t.regionFree {
+		estimate += free
+	}
+	atomic.StoreUint64(&t.estimate, estimate)
+	front := t.waiters.Front()
+	if !grown || front == nil {
+		return
+	}
+	w := front.Value.(*spaceWaiter)
+	enough := t.totalFreeSpace >= w.size
+	for _, free := range t.regionFree {
+		enough = enough || free >= w.size
+	}
+	if enough {
+		select {
+		case w.ready <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// addRegion makes r report its free space to t so that the waiters queued in t are notified when r
+// has enough free space
+func (t *freeSpaceManager) addRegion(r *freeSpaceManager) {
+	t.Lock()
+	defer t.Unlock()
+	r.queue = t
+	r.region = len(t.regionFree)
+	t.regionFree = append(t.regionFree, r.totalFreeSpace)
+	t.notifyWaiter(true)
+}
+
+// reportFree records the free space of the region and notifies the waiter at the head of the queue if it grew
+func (t *freeSpaceManager) reportFree(region int, free uint64, grown bool) {
+	t.Lock()
+	defer t.Unlock()
+	t.regionFree[region] = free
+	t.notifyWaiter(grown)
+}
+
+// unblock notifies the waiter at the head of the queue if there's enough free space for it, as the free spaces
+// can now be merged across a span they couldn't be merged across before
+func (t *freeSpaceManager) unblock() {
+	t.Lock()
+	defer t.Unlock()
+	t.notifyWaiter(true)
+}
+
 func (t *freeSpaceManager) waitForExtractedFreeSpaces() {
 	for t.extractedFreeSpaces > 0 {
 		t.pcond.Wait()
@@ -111,6 +414,23 @@ func (t *freeSpaceManager) totalFreeSpaceSize() uint64 {
 	return atomic.LoadUint64(&t.totalFreeSpace)
 }
 
+// freeSpaceStats walks all the free spaces and reports their count, the largest one and the histogram of their sizes
+func (t *freeSpaceManager) freeSpaceStats() (count uint64, largest uint64, histogram [64]uint64) {
+	t.Lock()
+	defer t.Unlock()
+	t.waitForExtractedFreeSpaces()
+	treap.Walk(t.root, func(fs *treap.FreeSpace) bool {
+		size := fs.Size()
+		count++
+		if size > largest {
+			largest = size
+		}
+		histogram[bits.Len64(size)-1]++
+		return true
+	})
+	return
+}
+
 func (t *freeSpaceManager) printLayout() {
 
 	log.Printf("-----------Total Free Space (%vmap)---------------\n", t.totalFreeSpace)
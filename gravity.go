@@ -1,7 +1,7 @@
 package gravity
 
 import (
-	"encoding/binary"
+	"context"
 	"errors"
 	"fmt"
 	"ohalloc/treap"
@@ -11,137 +11,798 @@ import (
 
 type Gravity struct {
 	sync.RWMutex
-	mem  []byte            // Entire mem in bytes
-	fsm  *freeSpaceManager // Manages the free space
-	size uint64            // Total size of memory (same as len(mem))
-	key  uint64            // Unique key for each data
-	vmap *vmap             // Stores key to position of data
+	mem     []byte            // Entire mem in bytes
+	fsm     *freeSpaceManager // Manages the free space
+	size    uint64            // End of the usable memory (len(mem) trimmed to the alignment)
+	key     uint64            // Unique key for each data
+	vmap    *vmap             // Stores key to position of data
+	base    uint64            // Start of the data region (after the superblock if any)
+	hdrLen  uint64            // Total length of the fixed headers preceding the data of each record
+	align   uint64            // Alignment of the data of each record (1 if unaligned)
+	stats   counters          // Cumulative counters reported by Stats
+	slab    *slab             // Slab pages holding small records
+	journal *journal          // Journal of the moves, nil if disabled
+	// Writers that fit in a single free space place their records concurrently holding the read lock and
+	// placing shared. Walking the memory under the read lock requires placing exclusively
+	placing sync.RWMutex
+	keyMu   sync.Mutex // serialises persisting the key
+	lease   uint64     // key stored in the superblock
+	// Allocation buffers of the Gravity
+	buffers map[*Buffer]struct{}
+	bufMu   sync.Mutex
+	// Spans of the region held by open reservations, end by start. Records are never moved across them
+	reserved map[uint64]uint64
+	resMu    sync.Mutex
+	// Additional memory regions. A region refers to the Gravity it was added to as root, and ref is the
+	// value stored in the root's vmap for the keys held by the region
+	regions []*Gravity
+	root    *Gravity
+	ref     uint64
+	opts    *options
 }
 
 const (
 	headerLen = uint64(8) // length of header to store the size of data
 	keyLen    = uint64(8) // Size of key for the data
+
+	maxAlignment = uint64(4096) // Largest alignment of the data
 )
 
 var (
 	WrongReadPosition = errors.New("wrong read position")
+	BufferTooSmall    = errors.New("buffer too small")
 )
 
-func NewGravity(mem []byte) (*Gravity, error) {
+func NewGravity(mem []byte, opts ...Option) (*Gravity, error) {
+	g, err := newGravity(mem, newOptions(opts))
+	if err != nil {
+		return nil, err
+	}
+	if g.opts.superblock {
+		g.writeSuperblock()
+	}
+	if g.journal != nil {
+		g.clearJournal(g.opts.journal)
+	}
+	return g, g.freeAll()
+}
+
+// OpenGravity reopens memory previously written by a Gravity (for ex. a file backed mmap region).
+// The key to position index, the free spaces and the key counter are rebuilt by scanning the records
+// and free space markers present in the memory.
+// A superblock at the start of the memory is detected and validated, in which case it takes precedence
+// over the provided options
+func OpenGravity(mem []byte, opts ...Option) (*Gravity, error) {
+	o := newOptions(opts)
+	sb, err := ReadSuperblock(mem)
+	switch err {
+	case nil:
+		sb.apply(o)
+	case NoSuperblock:
+		o.superblock = false
+	default:
+		return nil, err
+	}
+	g, err := newGravity(mem, o)
+	if err != nil {
+		return nil, err
+	}
+	if sb != nil {
+		g.key = sb.Key
+	}
+	if g.journal != nil {
+		if err = g.recoverJournal(); err != nil {
+			return nil, err
+		}
+	}
+	serr := g.scan(g.base, func(s span) bool {
+		if s.free {
+			fs := &treap.FreeSpace{Start: s.pos, End: s.pos + s.size - 1}
+			if s.reserved {
+				// reserved for a record that wasn't committed
+				g.markFree(fs)
+			}
+			err = g.fsm.add(fs)
+			return err == nil
+		}
+		old, dup := g.vmap.load(s.key)
+		if s.key == 0 || (dup && (s.page || g.slab.isPage(s.key))) {
+			err = CorruptedMemory
+			return false
+		}
+		maxKey := s.key
+		switch {
+		case s.page:
+			if maxKey, err = g.loadPage(s); err != nil {
+				return false
+			}
+		case dup:
+			if err = g.dropDuplicate(s, old); err != nil {
+				return false
+			}
+		default:
+			g.vmap.store(s.key, s.pos)
+		}
+		if maxKey > g.key {
+			g.key = maxKey
+		}
+		return true
+	})
+	if serr != nil {
+		return nil, serr
+	}
+	if err != nil {
+		return nil, err
+	}
+	g.persistKey(g.key)
+	return g, nil
+}
+
+// dropDuplicate keeps a single copy of the record found at s whose key is already held at old (a position or a
+// slab locator) while reopening the memory. Relocating updates write the new copy before freeing the old one,
+// so a crash in between leaves both copies, either of which is a valid state of the interrupted update. The copy
+// found first is kept unless only the other one matches its checksum
+func (g *Gravity) dropDuplicate(s span, old uint64) error {
+	if !isSlabLocator(old) && g.opts.checksum {
+		if _, err := g.verifyRecord(old, s.key); err != nil {
+			if _, err = g.verifyRecord(s.pos, s.key); err == nil {
+				g.vmap.store(s.key, s.pos)
+				s.pos, s.size = old, g.spanLen(old)
+			}
+		}
+	}
+	return g.releaseSpan(s.pos, s.size)
+}
+
+// spanLen returns the length of the memory occupied by the record at pos
+func (g *Gravity) spanLen(pos uint64) uint64 {
+	h, _ := g.recordAt(pos)
+	return g.recordLen(h.dl, h.key)
+}
+
+func newGravity(mem []byte, o *options) (*Gravity, error) {
 	size := uint64(len(mem))
-	if size <= headerLen+keyLen {
+	base := uint64(0)
+	if o.superblock {
+		base = superblockLen
+	}
+	var j *journal
+	if o.journal != 0 {
+		if o.journal < minJournalLen {
+			return nil, errors.New("journal too small")
+		}
+		j = &journal{start: base, chunkLen: (o.journal-journalHeaderLen)/2 - journalSlotLen}
+		base += o.journal
+	}
+	hdrLen := headerLen + keyLen
+	if o.compactHeaders {
+		// the length and key are variable length and accounted for each record
+		hdrLen = 0
+	}
+	if o.checksum {
+		hdrLen += checksumLen
+	}
+	align := uint64(1)
+	if o.alignment != 0 {
+		if o.compactHeaders {
+			return nil, errors.New("alignment requires fixed length headers")
+		}
+		if o.alignment < headerLen || o.alignment > maxAlignment || o.alignment&(o.alignment-1) != 0 {
+			return nil, errors.New("alignment must be a power of two between 8 and 4096")
+		}
+		// the data of the first record starts at an aligned offset and every span is a multiple of the
+		// alignment, which keeps the data of every record aligned even as records are moved
+		align = o.alignment
+		base = alignUp(base+hdrLen, align) - hdrLen
+		if size > base {
+			size = base + (size-base)/align*align
+		}
+	}
+	if size <= base+hdrLen {
 		return nil, errors.New("input byte too small")
 	}
-
-	g := &Gravity{
-		mem:  mem,
-		fsm:  newFSM(),
-		size: size,
-		vmap: newShardedStore(),
-		key:  uint64(1),
+	fsm := newFSM()
+	if sp, ok := o.placement.(StatefulPlacement); ok {
+		fsm.placement = sp.Clone()
+	} else if o.placement != nil {
+		fsm.placement = o.placement
 	}
-	err := g.fsm.add(&treap.FreeSpace{Start: 0, End: size - 1})
-	return g, err
+	return &Gravity{
+		mem:     mem,
+		fsm:     fsm,
+		size:    size,
+		vmap:    newShardedStore(o.shards),
+		key:     uint64(1),
+		base:    base,
+		hdrLen:  hdrLen,
+		align:   align,
+		slab:    newSlab(o.slabPageSize, size-base, o.checksum),
+		journal: j,
+		opts:    o,
+	}, nil
+}
+
+// recordLen returns the length of the memory occupied by a record of data length dl and key k including
+// the headers and the padding to the alignment
+func (g *Gravity) recordLen(dl uint64, k uint64) uint64 {
+	return alignUp(g.headerLen(dl, k)+dl, g.align)
+}
+
+// alignUp rounds n up to a multiple of align which must be a power of two
+func alignUp(n uint64, align uint64) uint64 {
+	return (n + align - 1) &^ (align - 1)
 }
 
 // getKey increments the key atomically and returns the value
 func (g *Gravity) getKey() uint64 {
-	return atomic.AddUint64(&g.key, 1)
+	return g.getKeys(1)
+}
+
+// getKeys issues n consecutive keys at once and returns the first one
+func (g *Gravity) getKeys(n uint64) uint64 {
+	if g.root != nil {
+		return g.root.getKeys(n)
+	}
+	k := atomic.AddUint64(&g.key, n)
+	g.persistKey(k)
+	return k - n + 1
 }
 
 // Write adds data to the memory and returns a key.
-// The key acts as a reference to read the data
+// The key acts as a reference to read the data.
+// Writes that fit in a free space or a slab slot without moving any records run concurrently with other writes
+// and reads. Writes merging free spaces exclude other writes but not reads, only growing the memory takes the
+// write lock
 func (g *Gravity) Write(data []byte) (key uint64, err error) {
+	key, err = g.writeWith(nil, data)
+	return key, g.failed(err)
+}
+
+// failed counts err in the stats if the memory is out of space and returns it. Only the errors returned by the
+// public calls are counted, not the attempts made on the way in each region
+func (g *Gravity) failed(err error) error {
+	if err == NotEnoughSpace {
+		atomic.AddUint64(&g.stats.notEnoughSpace, 1)
+	}
+	return err
+}
+
+// writeWith issues a key and writes the data, bump allocating it from the allocation buffer b if not nil
+func (g *Gravity) writeWith(b *Buffer, data []byte) (key uint64, err error) {
+	g.RLock()
+	key = g.getKey()
+	err = needsMerge
+	if b != nil {
+		err = b.write(key, data)
+	}
+	if err == needsMerge {
+		err = g.writeFit(key, data)
+	}
+	if err == needsMerge {
+		err = g.writeMerged(key, data)
+	}
+	g.RUnlock()
+	if err != needsMerge {
+		return
+	}
+
 	g.Lock()
 	defer g.Unlock()
-	key = g.getKey()
-	err = g.write(key, data)
+	g.reclaim()
+	err = g.writeAny(key, data)
 	return
 }
 
+// writeMerged writes the data to the first region with enough space once its free spaces are merged.
+// Merging moves records, so other writers and walks of the memory are excluded while reads carry on. The caller
+// must hold the read lock. needsMerge is returned if the memory has to be grown, which requires the write lock
+func (g *Gravity) writeMerged(k uint64, data []byte) error {
+	g.placing.Lock()
+	defer g.placing.Unlock()
+	g.reclaim()
+	for _, r := range g.all() {
+		if err := r.write(k, data); err != NotEnoughSpace {
+			if err == nil {
+				g.refer(r, k)
+			}
+			return err
+		}
+	}
+	if g.opts.grow != nil {
+		return needsMerge
+	}
+	return NotEnoughSpace
+}
+
+// writeFit writes the data to the first region with a free space large enough for it, or with a free slot of
+// the data's size class. Records aren't moved so that the caller only needs the read lock. needsMerge is
+// returned if the data doesn't fit any region
+func (g *Gravity) writeFit(k uint64, data []byte) error {
+	g.placing.RLock()
+	defer g.placing.RUnlock()
+	for _, r := range g.all() {
+		if err := r.fit(k, data); err != needsMerge {
+			if err == nil {
+				g.refer(r, k)
+			}
+			return err
+		}
+	}
+	return needsMerge
+}
+
+// fit writes the data to the region without moving any records, needsMerge is returned if it doesn't fit
+func (g *Gravity) fit(k uint64, data []byte) error {
+	if c := g.slab.classOf(uint64(len(data))); c >= 0 {
+		return g.slabWrite(k, data, c, true)
+	}
+	fs, err := g.fsm.extractFit(g.recordLen(uint64(len(data)), k))
+	if err != nil {
+		return err
+	}
+	defer g.release(fs)
+	return g.place(fs, k, data)
+}
+
+// WriteContext writes the data like Write but blocks till enough space is freed when the memory is full.
+// Blocked writers are served in the order they arrived. ctx's error is returned if it's done before the data
+// could be written
+func (g *Gravity) WriteContext(ctx context.Context, data []byte) (uint64, error) {
+	// the key isn't known yet, the next key is a close enough estimate for compact headers
+	totalLen := g.recordLen(uint64(len(data)), atomic.LoadUint64(&g.key)+1)
+	if g.opts.grow != nil {
+		// the write only waits if the memory couldn't be grown
+		if key, err := g.writeWith(nil, data); err != NotEnoughSpace {
+			return key, err
+		}
+	}
+	g.RLock()
+	capacity := g.capacity()
+	g.RUnlock()
+	if totalLen > capacity {
+		return 0, g.failed(NotEnoughSpace)
+	}
+	w := g.fsm.enqueue(totalLen)
+	defer g.fsm.dequeue(w)
+	for {
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-w.ready:
+		}
+		key, err := g.writeWith(nil, data)
+		if err != NotEnoughSpace {
+			return key, err
+		}
+	}
+}
+
 func (g *Gravity) write(k uint64, data []byte) error {
 
+	// small records go to a slab page when enabled
+	if c := g.slab.classOf(uint64(len(data))); c >= 0 {
+		return g.slabWrite(k, data, c, false)
+	}
+	return g.writeRecord(k, data)
+}
+
+// writeRecord writes the data as an individual record
+func (g *Gravity) writeRecord(k uint64, data []byte) error {
+
 	// get data size
 	dl := uint64(len(data))
-	totalLen := headerLen + keyLen + dl
+	totalLen := g.recordLen(dl, k)
 
 	// try to fetch freespace for size
-	fss, err := g.fsm.poolExtract(totalLen)
+	fs, err := g.allocate(totalLen)
 	if err != nil {
 		return err
 	}
 
+	// remember to put the freespace back to the pool
+	defer g.release(fs)
+
+	return g.place(fs, k, data)
+}
+
+// allocate extracts free spaces from the pool and merges them to form a single free space of at least size
+// bytes. The free space must be returned to the pool with release once used
+func (g *Gravity) allocate(size uint64) (*treap.FreeSpace, error) {
+	fss, err := g.fsm.poolExtract(size)
+	if err != nil {
+		return nil, err
+	}
+	// records can't be moved across a reserved span
+	if _, walled := g.wallWithin(fss[0].End+1, fss[len(fss)-1].Start); walled {
+		g.fsm.putBack(fss)
+		return nil, NotEnoughSpace
+	}
 	// merge all freespaces to satisfy the data size
-	fs := g.merge(fss)
+	return g.merge(fss), nil
+}
 
-	// remember to put the freespace back to the pool
-	defer func() {
-		err := g.fsm.poolPut(fs)
-		if err == illegalPoolPut {
-			panic(fmt.Sprintf("Error while adding to pool: %v \n", err))
-		}
-	}()
+// release returns the remaining free space obtained from allocate to the pool
+func (g *Gravity) release(fs *treap.FreeSpace) {
+	err := g.fsm.poolPut(fs)
+	if err == illegalPoolPut {
+		panic(fmt.Sprintf("Error while adding to pool: %v \n", err))
+	}
+}
 
-	// write to the memory
+// place writes the record at the start of the allocated free space and shrinks the free space
+func (g *Gravity) place(fs *treap.FreeSpace, k uint64, data []byte) error {
+	if err := g.put(fs, k, data); err != nil {
+		return err
+	}
+	atomic.AddUint64(&g.stats.writes, 1)
+	return nil
+}
+
+// put is place without counting the write
+func (g *Gravity) put(fs *treap.FreeSpace, k uint64, data []byte) error {
+	totalLen := g.recordLen(uint64(len(data)), k)
+
+	// mark the remaining free space before writing the data so that a scan never
+	// runs into stale bytes past the record
 	npos := fs.Start
-	err = g.writeAt(npos, data, k)
+	fs.Start += totalLen
+	g.markFree(fs)
+
+	// write to the memory
+	err := g.writeAt(npos, data, k)
 	if err != nil {
+		fs.Start = npos
+		g.markFree(fs)
 		return err
 	}
 
 	// store virtual position
 	g.vmap.store(k, npos)
-
-	fs.Start += totalLen
 	return nil
 }
 
-// Reads the value stored in the position corresponding to the key
+// Reads the value stored in the position corresponding to the key.
+// Reads run concurrently with compaction, only a read of a record being moved waits for that record
 func (g *Gravity) Read(key uint64) ([]byte, error) {
 	g.RLock()
 	defer g.RUnlock()
-	pos, err := g.loadFromVPos(key)
+	var b []byte
+	err := g.withData(key, func(data []byte) error {
+		b = make([]byte, len(data))
+		n := copy(b, data)
+		if n != len(data) {
+			return errors.New(fmt.Sprintf("expected to write %v but wrote %v ", len(data), n))
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	if pos >= g.size {
-		return nil, WrongReadPosition
+	return b, nil
+}
+
+// View calls fn with the value stored for the key without copying it out of the memory.
+// The slice is only valid till fn returns and must not be modified or retained. fn must not call
+// Read, Write, Update or Free as the read lock is held during the call and the record can't be moved
+func (g *Gravity) View(key uint64, fn func(data []byte) error) error {
+	g.RLock()
+	defer g.RUnlock()
+	return g.withData(key, fn)
+}
+
+// ReadInto copies the value stored for the key into dst and returns the length of the value.
+// BufferTooSmall is returned along with the required length when dst can't hold the value
+func (g *Gravity) ReadInto(key uint64, dst []byte) (int, error) {
+	g.RLock()
+	defer g.RUnlock()
+	n := 0
+	err := g.withData(key, func(data []byte) error {
+		if len(dst) < len(data) {
+			n = len(data)
+			return BufferTooSmall
+		}
+		n = copy(dst, data)
+		return nil
+	})
+	return n, err
+}
+
+// withData calls fn with the slice of memory holding the value of the key. The caller must hold the read
+// lock. Records are moved, overwritten and freed with the vmap shard of their key locked (see readAndShift),
+// so the shard of the key, or of the slab page holding it, is read locked and the position reloaded while fn
+// runs. The key is located again if it was freed or moved to another slot or region in the meantime
+func (g *Gravity) withData(key uint64, fn func(data []byte) error) error {
+	var last *Gravity
+	lastPos := uint64(0)
+	for {
+		r, pos, err := g.locate(key)
+		if err != nil {
+			return err
+		}
+		data, s, err := r.lockData(key, pos)
+		if err == nil {
+			defer s.RUnlock()
+			return fn(data)
+		}
+		if r == last && pos == lastPos {
+			return err
+		}
+		last, lastPos = r, pos
+	}
+}
+
+// lockData returns the data of the key held by the region at pos (a position or a slab locator) along with
+// the read locked vmap shard guarding it. The shard is unlocked if an error is returned
+func (g *Gravity) lockData(key uint64, pos uint64) ([]byte, *shard, error) {
+	var s *shard
+	var data []byte
+	var err error
+	if isSlabLocator(pos) {
+		p, _, ok := g.slab.page(pos)
+		if !ok {
+			return nil, nil, WrongReadPosition
+		}
+		s = g.vmap.rlocked(p.key)
+		if pagePos, ok := s.m[p.key]; ok {
+			data, err = g.slotData(key, pos, p, pagePos)
+		} else {
+			err = WrongReadPosition
+		}
+	} else {
+		s = g.vmap.rlocked(key)
+		if pos, ok := s.m[key]; ok && !isSlabLocator(pos) {
+			data, err = g.recordData(key, pos)
+		} else {
+			err = WrongReadPosition
+		}
 	}
-	dl := binary.LittleEndian.Uint64(g.mem[pos : pos+headerLen])
-	pos += headerLen + keyLen
-	b := make([]byte, dl)
-	n := copy(b, g.mem[pos:pos+dl])
-	if n != int(dl) {
-		return nil, errors.New(fmt.Sprintf("expected to write %v but wrote %v ", dl, n))
+	if err != nil {
+		s.RUnlock()
+		return nil, nil, err
 	}
-	return b, nil
+	return data, s, nil
+}
+
+// recordData returns the slice of memory holding the value of the record of the key at pos
+func (g *Gravity) recordData(key uint64, pos uint64) ([]byte, error) {
+	h, err := g.verifyRecord(pos, key)
+	if err != nil {
+		return nil, err
+	}
+	pos += h.hl
+	return g.mem[pos : pos+h.dl : pos+h.dl], nil
 }
 
-// Frees the memory held by the data pointed by key
+// Frees the memory held by the data pointed by key.
+// Frees run concurrently with reads and the writes that don't move any records
 func (g *Gravity) Free(key uint64) error {
+	g.RLock()
+	defer g.RUnlock()
+	g.placing.RLock()
+	defer g.placing.RUnlock()
+
+	r, pos, err := g.take(key)
+	if err != nil {
+		return err
+	}
+	// the space is returned to the pool before placing is released so that a record is always
+	// either reachable from vmap or part of a free space when merge or Iterate walks the memory
+	return r.free(pos)
+}
+
+// free releases the record or the slab slot at pos
+func (g *Gravity) free(pos uint64) error {
+	if isSlabLocator(pos) {
+		return g.slabFree(pos)
+	}
+	return g.freeAt(pos)
+}
+
+// Update replaces the data pointed by key while retaining the key.
+// The data is overwritten in place if it fits within the existing record along with its adjacent
+// free spaces, otherwise the record is relocated, to another region if its own region is full.
+// Like the writes merging free spaces, updates exclude other writes but not reads unless the memory has
+// to be grown
+func (g *Gravity) Update(key uint64, data []byte) error {
+	g.RLock()
+	g.placing.Lock()
+	g.reclaim()
+	err := g.replace(key, data, false)
+	g.placing.Unlock()
+	g.RUnlock()
+	if err != NotEnoughSpace || g.opts.grow == nil {
+		return g.failed(err)
+	}
+
+	// nothing was modified as no region could allocate the space
 	g.Lock()
+	defer g.Unlock()
+	g.reclaim()
+	return g.failed(g.replace(key, data, true))
+}
 
-	pos, err := g.loadAndDeleteFromVPos(key)
+// replace updates the data of the key in the region holding it, or in another region if it's full. The
+// memory is grown if no region has enough space and grow is set, which requires the write lock
+func (g *Gravity) replace(key uint64, data []byte, grow bool) error {
+	r, pos, err := g.locate(key)
 	if err != nil {
-		g.Unlock()
 		return err
 	}
+	err = r.update(key, pos, data)
+	if err != NotEnoughSpace {
+		return err
+	}
+	// nothing was modified as the region couldn't allocate the space
+	return g.updateElsewhere(r, key, pos, data, grow)
+}
 
-	dl := binary.LittleEndian.Uint64(g.mem[pos : pos+headerLen])
-	g.Unlock()
+// updateElsewhere writes the data for the key held at pos by the full region r to another region, or to the
+// grown memory if grow is set, and frees the existing record
+func (g *Gravity) updateElsewhere(r *Gravity, key uint64, pos uint64, data []byte, grow bool) error {
+	err := NotEnoughSpace
+	var o *Gravity
+	for _, o = range g.all() {
+		if o == r {
+			continue
+		}
+		if err = o.write(key, data); err != NotEnoughSpace {
+			break
+		}
+	}
+	if err == NotEnoughSpace && grow {
+		if err = g.grow(g.spaceFor(key, data)); err != nil {
+			return err
+		}
+		if r == g {
+			// the existing record was migrated along with the rest
+			pos, _ = g.vmap.load(key)
+			return g.update(key, pos, data)
+		}
+		o = g
+		err = g.write(key, data)
+	}
+	if err != nil {
+		return err
+	}
+	g.refer(o, key)
+	if r != g {
+		r.vmap.loadAndDelete(key)
+	}
+	return r.free(pos)
+}
+
+// update replaces the data of the key present at pos in the region
+func (g *Gravity) update(key uint64, pos uint64, data []byte) error {
+	if isSlabLocator(pos) {
+		return g.slabUpdate(key, pos, data)
+	}
+	h, _ := g.recordAt(pos)
+	oldLen := g.recordLen(h.dl, key)
+	newLen := g.recordLen(uint64(len(data)), key)
+
+	slot := &treap.FreeSpace{Start: pos, End: pos + oldLen - 1}
+	if newLen > oldLen {
+		prev, next, ok := g.fsm.extractNeighbours(slot.Start, slot.End, newLen)
+		if !ok {
+			return g.relocate(key, data)
+		}
+		if prev != nil {
+			slot.Start = prev.Start
+		}
+		if next != nil {
+			slot.End = next.End
+		}
+	}
+
+	// mark the leftover tail before overwriting the record so that the old header never
+	// points past a valid span. Readers of the key are held off while it's overwritten
+	tail := &treap.FreeSpace{Start: slot.Start + newLen, End: slot.End}
+	s := g.vmap.locked(key)
+	g.markFree(tail)
+	err := g.writeAt(slot.Start, data, key)
+	if err == nil {
+		s.m[key] = slot.Start
+	}
+	s.Unlock()
+	if err != nil {
+		return err
+	}
+	if tail.Size() > 0 {
+		return g.fsm.add(tail)
+	}
+	return nil
+}
 
-	totalDataSize := headerLen + keyLen + dl
-	return g.fsm.add(&treap.FreeSpace{Start: pos, End: pos + totalDataSize - 1})
+// relocate writes the data to a new position for the key and frees the existing record
+func (g *Gravity) relocate(key uint64, data []byte) error {
+	fs, err := g.allocate(g.recordLen(uint64(len(data)), key))
+	if err != nil {
+		return err
+	}
+	defer g.release(fs)
+
+	// merging free spaces could have moved the existing record
+	pos, _ := g.vmap.load(key)
+	if err = g.place(fs, key, data); err != nil {
+		return err
+	}
+	return g.freeAt(pos)
 }
 
-// TotalFreeSpace indicates the remaining free space available
+// freeAt returns the space held by the record at pos to the pool
+func (g *Gravity) freeAt(pos uint64) error {
+	h, _ := g.recordAt(pos)
+	atomic.AddUint64(&g.stats.frees, 1)
+	return g.releaseSpan(pos, g.recordLen(h.dl, h.key))
+}
+
+// releaseSpan marks size bytes from pos as free and adds them to the pool
+func (g *Gravity) releaseSpan(pos uint64, size uint64) error {
+	fs := &treap.FreeSpace{Start: pos, End: pos + size - 1}
+	g.markFree(fs)
+	return g.fsm.add(fs)
+}
+
+// Iterate calls fn for every live record in the order they are laid out in memory, region by region.
+// pos is the position of the record within its region. Iteration stops when fn returns false.
+// data refers to the underlying memory and is only valid till fn returns. fn must not call
+// Write or Free as the read lock is held for the entire iteration
+func (g *Gravity) Iterate(fn func(pos uint64, key uint64, data []byte) bool) {
+	g.RLock()
+	defer g.RUnlock()
+	g.placing.Lock()
+	defer g.placing.Unlock()
+	g.reclaim()
+
+	for _, r := range g.all() {
+		if !r.iterate(fn) {
+			return
+		}
+	}
+}
+
+// iterate calls fn for every live record in the region and returns false if fn stopped the iteration
+func (g *Gravity) iterate(fn func(pos uint64, key uint64, data []byte) bool) bool {
+	more := true
+	_ = g.scan(g.base, func(s span) bool {
+		if s.free {
+			return true
+		}
+		if s.page {
+			more = g.iteratePage(s.pos, s.key, fn)
+			return more
+		}
+		dataStart := s.pos + s.hl
+		more = fn(s.pos, s.key, g.mem[dataStart:dataStart+s.dl])
+		return more
+	})
+	return more
+}
+
+// TotalFreeSpace indicates the remaining free space available across all the regions
 func (g *Gravity) TotalFreeSpace() uint64 {
-	return g.fsm.totalFreeSpaceSize()
+	g.RLock()
+	defer g.RUnlock()
+	total := uint64(0)
+	for _, r := range g.all() {
+		buffered, _ := g.buffered(r)
+		total += r.fsm.totalFreeSpaceSize() + buffered
+	}
+	return total
+}
+
+// freeEstimate returns the free space across all the regions last published by the free space managers without
+// taking any lock. Free spaces being written to or merged and the chunks of allocation buffers aren't included
+func (g *Gravity) freeEstimate() uint64 {
+	return atomic.LoadUint64(&g.fsm.estimate)
 }
 
 // merge joins multiple freespaces to form a single large free space. i.e, all freespaces shifted to the right
 // by moving the data to the left
 func (g *Gravity) merge(fss []*treap.FreeSpace) *treap.FreeSpace {
+	if len(fss) > 1 {
+		atomic.AddUint64(&g.stats.merges, 1)
+	}
 	// obtain lock as data is moved and vmap is updated
 	for i := 0; i < len(fss)-1; i++ {
 		fs := fss[i]
@@ -160,50 +821,42 @@ func (g *Gravity) merge(fss []*treap.FreeSpace) *treap.FreeSpace {
 // Writes the data at given position and returns the key
 func (g *Gravity) writeAt(pos uint64, data []byte, k uint64) error {
 	dl := uint64(len(data))
-	binary.LittleEndian.PutUint64(g.mem[pos:pos+headerLen], dl)
-	pos += headerLen
-	binary.LittleEndian.PutUint64(g.mem[pos:pos+keyLen], k)
-	pos += keyLen
-	n := copy(g.mem[pos:pos+dl], data)
+	h := g.putRecordHeader(pos, dl, k)
+	n := copy(g.mem[pos+h.hl:pos+h.hl+dl], data)
 	if n != len(data) {
 		return errors.New(fmt.Sprintf("expected to write %v  but wrote %v ", dl, n))
 	}
+	g.putChecksum(pos, h)
 	return nil
 }
 
-// readAndShift reads all the data from srcStart:srcEnd and moves them to dstStart:dstEnd
+// readAndShift reads all the data from srcStart:srcEnd and moves them to dstStart:dstEnd.
+// The records are moved one at a time in order with the vmap shard of their key locked. Moving a record only
+// overwrites records already moved and itself, so readers holding the shard of any other record are unaffected
+// and readers of the record either read it before it's moved or read it at its new position
 func (g *Gravity) readAndShift(srcStart uint64, srcEnd uint64, dstStart uint64, dstEnd uint64) {
-	// update existing data pos
-	runningDataLength := uint64(0)
-	start := srcStart
-
-	for start < srcEnd {
-		if start+headerLen+keyLen > g.size {
+	dst := dstStart
+	for src := srcStart; src < srcEnd; {
+		h, ok := g.recordAt(src)
+		if !ok {
 			panic("Trying to move src beyond size")
 		}
-		dl := binary.LittleEndian.Uint64(g.mem[start : start+headerLen])
+		n := g.recordLen(h.dl, h.key)
+		s := g.vmap.locked(h.key)
+		g.move(dst, src, n)
 		// rewire key position
-		key := binary.LittleEndian.Uint64(g.mem[start+headerLen : start+headerLen+keyLen])
-		g.vmap.store(key, dstStart+runningDataLength)
-
-		currentLen := dl + headerLen + keyLen
-		runningDataLength += currentLen
-		start += currentLen
+		s.m[h.key] = dst
+		s.Unlock()
+		src += n
+		dst += n
 	}
-	copy(g.mem[dstStart:dstEnd], g.mem[srcStart:srcEnd])
+	atomic.AddUint64(&g.stats.bytesMoved, srcEnd-srcStart)
 }
 
+// loadFromVPos returns the position or the slab locator of the key. Keys of slab pages aren't exposed
 func (g *Gravity) loadFromVPos(key uint64) (uint64, error) {
 	pos, ok := g.vmap.load(key)
-	if !ok {
-		return 0, WrongReadPosition
-	}
-	return pos, nil
-}
-
-func (g *Gravity) loadAndDeleteFromVPos(key uint64) (uint64, error) {
-	pos, ok := g.vmap.loadAndDelete(key)
-	if !ok {
+	if !ok || g.slab.isPage(key) {
 		return 0, WrongReadPosition
 	}
 	return pos, nil
@@ -1,10 +1,16 @@
 package gravity
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/dustin/go-humanize"
 	"github.com/stretchr/testify/require"
+	"io"
 	"math/rand"
+	"ohalloc/treap"
 	"runtime"
 	"strings"
 	"sync"
@@ -235,10 +241,2043 @@ func TestGravity_Bad(t *testing.T) {
 	require.Equal(t, err.Error(), WrongReadPosition.Error())
 }
 
+func TestGravity_Iterate(t *testing.T) {
+	inp := strings.Split("a quick brown fox jumped over the lazy dog", " ")
+	g := getGravity(inp)
+	var keys []uint64
+	for _, s := range inp {
+		k, err := g.Write([]byte(s))
+		require.NoError(t, err)
+		keys = append(keys, k)
+	}
+	removed := map[int]bool{0: true, 4: true, 7: true}
+	for i := range removed {
+		require.NoError(t, g.Free(keys[i]))
+	}
+
+	t.Run("memory order", func(t *testing.T) {
+		var expected []string
+		for i, s := range inp {
+			if !removed[i] {
+				expected = append(expected, s)
+			}
+		}
+		var found []string
+		lastPos := int64(-1)
+		g.Iterate(func(pos uint64, key uint64, data []byte) bool {
+			require.Greater(t, int64(pos), lastPos)
+			lastPos = int64(pos)
+			d, err := g.Read(key)
+			require.NoError(t, err)
+			require.Equal(t, d, data)
+			found = append(found, string(data))
+			return true
+		})
+		require.Equal(t, expected, found)
+	})
+
+	t.Run("stop early", func(t *testing.T) {
+		count := 0
+		g.Iterate(func(pos uint64, key uint64, data []byte) bool {
+			count++
+			return count < 2
+		})
+		require.Equal(t, 2, count)
+	})
+
+	t.Run("after merge", func(t *testing.T) {
+		_, err := g.Write(randBytes(int(g.TotalFreeSpace() - headerLen - keyLen)))
+		require.NoError(t, err)
+		count := 0
+		g.Iterate(func(pos uint64, key uint64, data []byte) bool {
+			count++
+			return true
+		})
+		require.Equal(t, len(inp)-len(removed)+1, count)
+	})
+}
+
+func TestGravity_Open(t *testing.T) {
+	inp := strings.Split("a quick brown fox jumped over the lazy dog", " ")
+	mem := make([]byte, 400)
+	g, err := NewGravity(mem)
+	require.NoError(t, err)
+	written := make(map[uint64]string)
+	for i, s := range inp {
+		k, err := g.Write([]byte(s))
+		require.NoError(t, err)
+		written[k] = s
+		if i%3 == 0 {
+			require.NoError(t, g.Free(k))
+			delete(written, k)
+		}
+	}
+
+	t.Run("reopen", func(t *testing.T) {
+		rg, err := OpenGravity(append([]byte(nil), mem...))
+		require.NoError(t, err)
+		require.Equal(t, g.TotalFreeSpace(), rg.TotalFreeSpace())
+		for k, s := range written {
+			d, err := rg.Read(k)
+			require.NoError(t, err)
+			require.Equal(t, []byte(s), d)
+		}
+		k, err := rg.Write([]byte("new"))
+		require.NoError(t, err)
+		_, exists := written[k]
+		require.False(t, exists)
+	})
+
+	t.Run("reopen after merge", func(t *testing.T) {
+		mem := make([]byte, getGravity(inp).size)
+		g, _ := NewGravity(mem)
+		var keys []uint64
+		for _, s := range inp {
+			k, err := g.Write([]byte(s))
+			require.NoError(t, err)
+			keys = append(keys, k)
+		}
+		require.NoError(t, g.Free(keys[1]))
+		require.NoError(t, g.Free(keys[5]))
+		// occupies the freed spaces along with the tiny space left at the end
+		data := randBytes(int(g.TotalFreeSpace() - headerLen - keyLen - 1))
+		k, err := g.Write(data)
+		require.NoError(t, err)
+
+		rg, err := OpenGravity(mem)
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), rg.TotalFreeSpace())
+		d, err := rg.Read(k)
+		require.NoError(t, err)
+		require.Equal(t, data, d)
+	})
+
+	t.Run("corrupted", func(t *testing.T) {
+		_, err := OpenGravity(make([]byte, 100))
+		require.Equal(t, CorruptedMemory, err)
+	})
+}
+
+func TestGravity_Superblock(t *testing.T) {
+	mem := make([]byte, 500)
+	g, err := NewGravity(mem, WithSuperblock())
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(mem))-superblockLen, g.TotalFreeSpace())
+
+	k1, err := g.Write([]byte("hello"))
+	require.NoError(t, err)
+	k2, err := g.Write([]byte("world"))
+	require.NoError(t, err)
+	// the last key is no longer present in memory but should never be reissued
+	require.NoError(t, g.Free(k2))
+
+	sb, err := ReadSuperblock(mem)
+	require.NoError(t, err)
+	require.Equal(t, sbVersion, sb.Version)
+	require.GreaterOrEqual(t, sb.Key, k2)
+
+	t.Run("reopen", func(t *testing.T) {
+		rg, err := OpenGravity(append([]byte(nil), mem...))
+		require.NoError(t, err)
+		d, err := rg.Read(k1)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello"), d)
+		k, err := rg.Write([]byte("again"))
+		require.NoError(t, err)
+		require.Greater(t, k, k2)
+	})
+
+	t.Run("layout flags", func(t *testing.T) {
+		require.Equal(t, uint32(0), sb.Flags)
+		// slab pages aren't written to an arena created without them
+		rg, err := OpenGravity(append([]byte(nil), mem...), WithSlab(0))
+		require.NoError(t, err)
+		require.Equal(t, -1, rg.slab.classOf(1))
+
+		m := make([]byte, 8192)
+		_, err = NewGravity(m, WithSuperblock(), WithAlignment(16), WithSlab(0))
+		require.NoError(t, err)
+		s, err := ReadSuperblock(m)
+		require.NoError(t, err)
+		require.Equal(t, sbFlagAligned|sbFlagSlab, s.Flags)
+		rg, err = OpenGravity(m, WithSlab(0))
+		require.NoError(t, err)
+		require.Equal(t, uint64(16), rg.align)
+		require.Equal(t, 0, rg.slab.classOf(1))
+	})
+
+	t.Run("incompatible", func(t *testing.T) {
+		bad := append([]byte(nil), mem...)
+		bad[sbVersionOffset]++
+		_, err := OpenGravity(bad)
+		require.Equal(t, IncompatibleFormat, err)
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		raw := make([]byte, 100)
+		_, err := NewGravity(raw)
+		require.NoError(t, err)
+		_, err = ReadSuperblock(raw)
+		require.Equal(t, NoSuperblock, err)
+	})
+}
+
+func TestGravity_Checksum(t *testing.T) {
+	mem := make([]byte, 500)
+	g, err := NewGravity(mem, WithChecksum())
+	require.NoError(t, err)
+	var keys []uint64
+	for _, s := range strings.Split("a quick brown fox", " ") {
+		k, err := g.Write([]byte(s))
+		require.NoError(t, err)
+		keys = append(keys, k)
+	}
+	require.NoError(t, g.Scrub())
+
+	// flip a data byte of the second record and the key of the third record
+	pos, _ := g.vmap.load(keys[1])
+	mem[pos+g.hdrLen] ^= 0xff
+	pos, _ = g.vmap.load(keys[2])
+	mem[pos+headerLen]++
+
+	_, err = g.Read(keys[1])
+	var cerr *CorruptionError
+	require.True(t, errors.As(err, &cerr))
+	require.Equal(t, keys[1], cerr.Key)
+	require.True(t, errors.Is(err, ChecksumMismatch))
+
+	_, err = g.Read(keys[2])
+	require.True(t, errors.Is(err, KeyMismatch))
+
+	d, err := g.Read(keys[0])
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), d)
+
+	err = g.Scrub()
+	var serr *ScrubError
+	require.True(t, errors.As(err, &serr))
+	require.Equal(t, []uint64{keys[1], keys[2]}, serr.Keys())
+}
+
+func TestGravity_Update(t *testing.T) {
+	setup := func(size int) (*Gravity, []uint64) {
+		g, _ := NewGravity(make([]byte, size))
+		var keys []uint64
+		for _, s := range []string{"first", "second", "third"} {
+			k, err := g.Write([]byte(s))
+			require.NoError(t, err)
+			keys = append(keys, k)
+		}
+		return g, keys
+	}
+	verify := func(g *Gravity, key uint64, expected string) {
+		d, err := g.Read(key)
+		require.NoError(t, err)
+		require.Equal(t, []byte(expected), d)
+		// memory should remain scannable
+		_, err = OpenGravity(append([]byte(nil), g.mem...))
+		require.NoError(t, err)
+	}
+
+	t.Run("shrink", func(t *testing.T) {
+		g, keys := setup(200)
+		initFree := g.TotalFreeSpace()
+		pos, _ := g.vmap.load(keys[1])
+		require.NoError(t, g.Update(keys[1], []byte("2nd")))
+		npos, _ := g.vmap.load(keys[1])
+		require.Equal(t, pos, npos)
+		require.Equal(t, initFree+3, g.TotalFreeSpace())
+		verify(g, keys[1], "2nd")
+		verify(g, keys[2], "third")
+	})
+
+	t.Run("grow into neighbours", func(t *testing.T) {
+		// no free space apart from the ones left by the freed records
+		g, keys := setup(3*int(headerLen+keyLen) + len("firstsecondthird"))
+		require.NoError(t, g.Free(keys[0]))
+		require.NoError(t, g.Free(keys[2]))
+		// requires the free spaces on both the sides
+		data := randBytes(len("firstsecondthird") + 2*int(headerLen+keyLen) - 1)
+		require.NoError(t, g.Update(keys[1], data))
+		pos, _ := g.vmap.load(keys[1])
+		require.Equal(t, uint64(0), pos)
+		require.Equal(t, uint64(1), g.TotalFreeSpace())
+		verify(g, keys[1], string(data))
+	})
+
+	t.Run("relocate", func(t *testing.T) {
+		g, keys := setup(200)
+		initFree := g.TotalFreeSpace()
+		require.NoError(t, g.Update(keys[0], []byte("first one with more data")))
+		pos, _ := g.vmap.load(keys[0])
+		require.NotEqual(t, uint64(0), pos)
+		require.Equal(t, initFree-uint64(len(" one with more data")), g.TotalFreeSpace())
+		verify(g, keys[0], "first one with more data")
+		verify(g, keys[1], "second")
+	})
+
+	t.Run("interrupted relocation", func(t *testing.T) {
+		// restores the old copy of the relocated record as if the update crashed before freeing it
+		relocate := func(opts ...Option) (uint64, uint64, []byte) {
+			mem := make([]byte, 300)
+			g, _ := NewGravity(mem, opts...)
+			k, _ := g.Write([]byte("old"))
+			_, err := g.Write([]byte("next"))
+			require.NoError(t, err)
+			// the first span holds the record or the slab page of its slot
+			n := g.spanLen(0)
+			before := append([]byte(nil), mem[:n]...)
+			free := g.TotalFreeSpace()
+			require.NoError(t, g.Update(k, []byte(strings.Repeat("new", 40))))
+			copy(mem, before)
+			return free, k, mem
+		}
+		reopen := func(mem []byte, k uint64, expected string, opts ...Option) {
+			o, err := OpenGravity(mem, opts...)
+			require.NoError(t, err)
+			d, err := o.Read(k)
+			require.NoError(t, err)
+			require.Equal(t, expected, string(d))
+			require.NoError(t, o.Scrub())
+			n := 0
+			o.Iterate(func(pos uint64, key uint64, data []byte) bool {
+				n++
+				return true
+			})
+			require.Equal(t, 2, n)
+		}
+
+		// the new copy is released
+		free, k, mem := relocate()
+		reopen(mem, k, "old")
+		o, _ := OpenGravity(mem)
+		require.Equal(t, free, o.TotalFreeSpace())
+
+		// the old copy is torn
+		_, k, mem = relocate(WithChecksum())
+		mem[headerLen+keyLen+checksumLen] ^= 0xff
+		reopen(mem, k, strings.Repeat("new", 40), WithChecksum())
+
+		_, k, mem = relocate(WithSlab(128))
+		reopen(mem, k, "old", WithSlab(128))
+	})
+
+	t.Run("not enough space", func(t *testing.T) {
+		g, keys := setup(200)
+		require.Equal(t, NotEnoughSpace, g.Update(keys[1], make([]byte, 500)))
+		verify(g, keys[1], "second")
+		require.Equal(t, WrongReadPosition, g.Update(100, nil))
+	})
+}
+
+func TestGravity_View(t *testing.T) {
+	g, _ := NewGravity(make([]byte, 100))
+	k, err := g.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	t.Run("view", func(t *testing.T) {
+		err := g.View(k, func(data []byte) error {
+			require.Equal(t, []byte("hello"), data)
+			require.Equal(t, len(data), cap(data))
+			return nil
+		})
+		require.NoError(t, err)
+		cbErr := errors.New("callback error")
+		require.Equal(t, cbErr, g.View(k, func(data []byte) error { return cbErr }))
+		require.Equal(t, WrongReadPosition, g.View(k+1, func(data []byte) error { return nil }))
+	})
+
+	t.Run("read into", func(t *testing.T) {
+		small := make([]byte, 2)
+		n, err := g.ReadInto(k, small)
+		require.Equal(t, BufferTooSmall, err)
+		require.Equal(t, 5, n)
+
+		dst := make([]byte, 10)
+		n, err = g.ReadInto(k, dst)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello"), dst[:n])
+	})
+}
+
+func TestGravity_Reserve(t *testing.T) {
+	g, _ := NewGravity(make([]byte, 100), WithChecksum())
+	initFree := g.TotalFreeSpace()
+
+	t.Run("commit", func(t *testing.T) {
+		r, err := g.Reserve(5)
+		require.NoError(t, err)
+		require.Len(t, r.Bytes(), 5)
+		copy(r.Bytes(), "hello")
+		k, err := r.Commit()
+		require.NoError(t, err)
+		d, err := g.Read(k)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello"), d)
+		_, err = r.Commit()
+		require.Equal(t, ReservationDone, err)
+		require.NoError(t, g.Free(k))
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		r, err := g.Reserve(20)
+		require.NoError(t, err)
+		require.NoError(t, r.Abort())
+		require.Equal(t, ReservationDone, r.Abort())
+		require.Equal(t, initFree, g.TotalFreeSpace())
+		_, err = OpenGravity(append([]byte(nil), g.mem...), WithChecksum())
+		require.NoError(t, err)
+	})
+
+	t.Run("not enough space", func(t *testing.T) {
+		_, err := g.Reserve(int(initFree))
+		require.Equal(t, NotEnoughSpace, err)
+		// the lock must have been released
+		_, err = g.Write([]byte("x"))
+		require.NoError(t, err)
+	})
+
+	t.Run("reads and writes while reserved", func(t *testing.T) {
+		g, _ := NewGravity(make([]byte, 1024), WithChecksum())
+		k1, err := g.Write([]byte("before"))
+		require.NoError(t, err)
+		r, err := g.Reserve(8)
+		require.NoError(t, err)
+		done := make(chan error)
+		go func() {
+			_, err := g.Read(k1)
+			if err == nil {
+				var k uint64
+				if k, err = g.Write([]byte("during")); err == nil {
+					err = g.Free(k)
+				}
+			}
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("read or write blocked by a reservation")
+		}
+		copy(r.Bytes(), "reserved")
+		k, err := r.Commit()
+		require.NoError(t, err)
+		d, err := g.Read(k)
+		require.NoError(t, err)
+		require.Equal(t, "reserved", string(d))
+		require.NoError(t, g.Scrub())
+	})
+
+	t.Run("records aren't moved across reservations", func(t *testing.T) {
+		g, _ := NewGravity(make([]byte, 1024), WithChecksum())
+		var keys []uint64
+		for i := 0; i < 4; i++ {
+			k, err := g.Write(bytes.Repeat([]byte{byte('a' + i)}, 50))
+			require.NoError(t, err)
+			keys = append(keys, k)
+		}
+		r, err := g.Reserve(20)
+		require.NoError(t, err)
+		copy(r.Bytes(), "partially written")
+		after, err := g.Write([]byte("after"))
+		require.NoError(t, err)
+		require.NoError(t, g.Free(keys[1]))
+		require.NoError(t, g.Free(keys[3]))
+		require.NoError(t, g.Free(after))
+
+		done := false
+		for i := 0; i < 10 && !done; i++ {
+			_, done = g.CompactStep(1)
+		}
+		require.True(t, done)
+		g.Compact()
+		require.True(t, g.compacted())
+		require.Equal(t, "partially written", string(r.Bytes()[:17]))
+		_, err = OpenGravity(append([]byte(nil), g.mem...), WithChecksum())
+		require.NoError(t, err)
+
+		// the free spaces on either side of the reservation can't be merged
+		s := g.Stats()
+		require.Equal(t, uint64(2), s.FreeSpaces)
+		_, err = g.Write(make([]byte, s.LargestFreeSpace+1-g.hdrLen))
+		require.Equal(t, NotEnoughSpace, err)
+
+		copy(r.Bytes()[17:], "!!!")
+		k, err := r.Commit()
+		require.NoError(t, err)
+		big, err := g.Write(make([]byte, s.LargestFreeSpace+1-g.hdrLen))
+		require.NoError(t, err)
+		for k, v := range map[uint64]string{
+			keys[0]: strings.Repeat("a", 50),
+			keys[2]: strings.Repeat("c", 50),
+			k:       "partially written!!!",
+			big:     string(make([]byte, s.LargestFreeSpace+1-g.hdrLen)),
+		} {
+			d, err := g.Read(k)
+			require.NoError(t, err)
+			require.Equal(t, v, string(d))
+		}
+		require.NoError(t, g.Scrub())
+	})
+
+	t.Run("reopened while reserved", func(t *testing.T) {
+		for _, opts := range [][]Option{{WithSuperblock(), WithChecksum()}, {WithSuperblock(), WithCompactHeaders()}} {
+			g, _ := NewGravity(make([]byte, 512), opts...)
+			free := g.TotalFreeSpace()
+			k, err := g.Write([]byte("committed"))
+			require.NoError(t, err)
+			for _, n := range []int{0, 1, 100} {
+				_, err = g.Reserve(n)
+				require.NoError(t, err)
+			}
+			o, err := OpenGravity(append([]byte(nil), g.mem...))
+			require.NoError(t, err)
+			require.Equal(t, free-g.recordLen(9, k), o.TotalFreeSpace())
+			d, err := o.Read(k)
+			require.NoError(t, err)
+			require.Equal(t, "committed", string(d))
+			require.NoError(t, o.Scrub())
+		}
+	})
+
+	t.Run("not grown or remapped while reserved", func(t *testing.T) {
+		g, _ := NewGravity(make([]byte, 256), WithGrow(func(size uint64) ([]byte, error) {
+			return make([]byte, 2*size), nil
+		}, nil))
+		r, err := g.Reserve(10)
+		require.NoError(t, err)
+		require.Equal(t, ReservationsOpen, g.Remap(append(append([]byte(nil), g.mem...), make([]byte, 256)...)))
+		_, err = g.Write(make([]byte, 300))
+		require.Equal(t, NotEnoughSpace, err)
+		require.NoError(t, r.Abort())
+		_, err = g.Write(make([]byte, 300))
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), g.Stats().Grows)
+	})
+}
+
+func TestGravity_Batch(t *testing.T) {
+	inp := strings.Split("a quick brown fox jumped over the lazy dog", " ")
+	var data [][]byte
+	for _, s := range inp {
+		data = append(data, []byte(s))
+	}
+	g := getGravity(inp)
+	initFree := g.TotalFreeSpace()
+
+	keys, err := g.WriteBatch(data)
+	require.NoError(t, err)
+	require.Len(t, keys, len(inp))
+	for i, k := range keys {
+		d, err := g.Read(k)
+		require.NoError(t, err)
+		require.Equal(t, data[i], d)
+	}
+
+	t.Run("write all or nothing", func(t *testing.T) {
+		free := g.TotalFreeSpace()
+		_, err := g.WriteBatch([][]byte{[]byte("x"), make([]byte, free)})
+		require.Equal(t, NotEnoughSpace, err)
+		require.Equal(t, free, g.TotalFreeSpace())
+	})
+
+	t.Run("free all or nothing", func(t *testing.T) {
+		require.Equal(t, WrongReadPosition, g.FreeBatch([]uint64{keys[0], keys[1], keys[0]}))
+		require.Equal(t, WrongReadPosition, g.FreeBatch([]uint64{keys[0], 1000}))
+		_, err := g.Read(keys[0])
+		require.NoError(t, err)
+	})
+
+	t.Run("free", func(t *testing.T) {
+		// free adjacent and non adjacent records in random order
+		require.NoError(t, g.FreeBatch([]uint64{keys[5], keys[1], keys[0], keys[2], keys[7]}))
+		for _, i := range []int{0, 1, 2, 5, 7} {
+			_, err := g.Read(keys[i])
+			require.Equal(t, WrongReadPosition, err)
+		}
+		d, err := g.Read(keys[3])
+		require.NoError(t, err)
+		require.Equal(t, data[3], d)
+		_, err = OpenGravity(append([]byte(nil), g.mem...))
+		require.NoError(t, err)
+
+		require.NoError(t, g.FreeBatch([]uint64{keys[3], keys[4], keys[6], keys[8]}))
+		require.Equal(t, initFree, g.TotalFreeSpace())
+	})
+}
+
+func TestGravity_WriteContext(t *testing.T) {
+	record := func(n int) uint64 { return uint64(n) + headerLen + keyLen }
+	g, _ := NewGravity(make([]byte, 3*record(10)))
+	var keys []uint64
+	for i := 0; i < 3; i++ {
+		k, err := g.WriteContext(context.Background(), randBytes(10))
+		require.NoError(t, err)
+		keys = append(keys, k)
+	}
+
+	t.Run("cancel", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := g.WriteContext(ctx, randBytes(10))
+		require.Equal(t, context.DeadlineExceeded, err)
+		_, err = g.WriteContext(context.Background(), randBytes(int(3*record(10))))
+		require.Equal(t, NotEnoughSpace, err)
+	})
+
+	t.Run("fifo", func(t *testing.T) {
+		var order []int
+		var omu sync.Mutex
+		wg := sync.WaitGroup{}
+		wait := func(i int, size int) {
+			defer wg.Done()
+			_, err := g.WriteContext(context.Background(), randBytes(size))
+			require.NoError(t, err)
+			omu.Lock()
+			order = append(order, i)
+			omu.Unlock()
+		}
+		// a large write followed by a small write
+		wg.Add(2)
+		go wait(0, int(record(10))+10)
+		time.Sleep(50 * time.Millisecond)
+		go wait(1, 10)
+		time.Sleep(50 * time.Millisecond)
+
+		// enough for the small write but it shouldn't overtake the large write
+		require.NoError(t, g.Free(keys[0]))
+		time.Sleep(50 * time.Millisecond)
+		omu.Lock()
+		require.Empty(t, order)
+		omu.Unlock()
+
+		require.NoError(t, g.Free(keys[2]))
+		require.NoError(t, g.Free(keys[1]))
+		wg.Wait()
+		require.Equal(t, []int{0, 1}, order)
+	})
+
+	t.Run("reservation", func(t *testing.T) {
+		// the free spaces are enough for the write but split by an open reservation
+		p := &countingPlacement{}
+		g, _ := NewGravity(make([]byte, 1024), WithPlacement(p))
+		k, err := g.Write(randBytes(200))
+		require.NoError(t, err)
+		r, err := g.Reserve(100)
+		require.NoError(t, err)
+		_, err = g.Write(randBytes(200))
+		require.NoError(t, err)
+		require.NoError(t, g.Free(k))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done := make(chan error)
+		go func() {
+			_, err := g.WriteContext(ctx, randBytes(500))
+			done <- err
+		}()
+		time.Sleep(100 * time.Millisecond)
+		// the waiter isn't notified again by its own failed attempts
+		require.Less(t, atomic.LoadInt64(&p.selects), int64(10))
+		_, err = r.Commit()
+		require.NoError(t, err)
+		require.NoError(t, <-done)
+	})
+}
+
+// countingPlacement counts the free spaces selected by GravityFit
+type countingPlacement struct {
+	GravityFit
+	selects int64
+}
+
+func (p *countingPlacement) Select(root *treap.Node, size uint64) *treap.Node {
+	atomic.AddInt64(&p.selects, 1)
+	return p.GravityFit.Select(root, size)
+}
+
+func TestGravity_Stats(t *testing.T) {
+	inp := []string{"hello", "my", "world"}
+	g := getGravity(inp)
+	var keys []uint64
+	for _, s := range inp {
+		k, err := g.Write([]byte(s))
+		require.NoError(t, err)
+		keys = append(keys, k)
+	}
+	require.NoError(t, g.Free(keys[1]))
+
+	s := g.Stats()
+	require.Equal(t, uint64(2), s.Records)
+	require.Equal(t, uint64(len("helloworld")), s.LiveBytes)
+	require.Equal(t, 2*(headerLen+keyLen), s.HeaderBytes)
+	require.Equal(t, uint64(2), s.FreeSpaces)
+	require.Equal(t, uint64(2+len("my"))+headerLen+keyLen, s.TotalFreeSpace)
+	require.Equal(t, uint64(len("my"))+headerLen+keyLen, s.LargestFreeSpace)
+	require.Equal(t, uint64(1), s.FreeSpaceHistogram[1])
+	require.Equal(t, uint64(1), s.FreeSpaceHistogram[4])
+	require.InDelta(t, 2.0/20.0, s.Fragmentation, 1e-9)
+	require.Equal(t, uint64(3), s.Writes)
+	require.Equal(t, uint64(1), s.Frees)
+	require.Equal(t, uint64(0), s.Merges)
+	require.Equal(t, s.Size, s.LiveBytes+s.HeaderBytes+s.TotalFreeSpace)
+
+	// requires merging both the free spaces by moving "world"
+	_, err := g.Write([]byte("four"))
+	require.NoError(t, err)
+	_, err = g.Write([]byte("five"))
+	require.Equal(t, NotEnoughSpace, err)
+
+	s = g.Stats()
+	require.Equal(t, uint64(1), s.Merges)
+	require.Equal(t, uint64(len("world"))+headerLen+keyLen, s.BytesMoved)
+	require.Equal(t, uint64(1), s.NotEnoughSpaceErrors)
+	require.Equal(t, uint64(0), s.FreeSpaces)
+	require.Equal(t, float64(0), s.Fragmentation)
+
+	// a failure is counted once for the call, not for every region tried
+	require.NoError(t, g.AddRegion(make([]byte, 30)))
+	_, err = g.Write(make([]byte, 50))
+	require.Equal(t, NotEnoughSpace, err)
+	require.Equal(t, uint64(2), g.Stats().NotEnoughSpaceErrors)
+}
+
+func TestGravity_Compact(t *testing.T) {
+	inp := strings.Split("a quick brown fox jumped over the lazy dog", " ")
+	setup := func() (*Gravity, map[uint64]string) {
+		g, _ := NewGravity(make([]byte, 400))
+		live := make(map[uint64]string)
+		var keys []uint64
+		for _, s := range inp {
+			k, err := g.Write([]byte(s))
+			require.NoError(t, err)
+			live[k] = s
+			keys = append(keys, k)
+		}
+		for i := 0; i < len(keys); i += 2 {
+			require.NoError(t, g.Free(keys[i]))
+			delete(live, keys[i])
+		}
+		return g, live
+	}
+	verify := func(g *Gravity, live map[uint64]string, initFree uint64) {
+		for k, s := range live {
+			d, err := g.Read(k)
+			require.NoError(t, err)
+			require.Equal(t, []byte(s), d)
+		}
+		st := g.Stats()
+		require.Equal(t, uint64(1), st.FreeSpaces)
+		require.Equal(t, initFree, st.TotalFreeSpace)
+		require.Equal(t, initFree, st.LargestFreeSpace)
+		_, err := OpenGravity(append([]byte(nil), g.mem...))
+		require.NoError(t, err)
+	}
+
+	t.Run("full", func(t *testing.T) {
+		g, live := setup()
+		initFree := g.TotalFreeSpace()
+		g.Compact()
+		verify(g, live, initFree)
+		// "quick" is moved to the start
+		pos, _ := g.vmap.load(uint64(3))
+		require.Equal(t, uint64(0), pos)
+	})
+
+	t.Run("step", func(t *testing.T) {
+		g, live := setup()
+		initFree := g.TotalFreeSpace()
+		steps := 0
+		for {
+			moved, done := g.CompactStep(30)
+			if done {
+				break
+			}
+			require.LessOrEqual(t, moved, uint64(30))
+			steps++
+		}
+		require.Greater(t, steps, 1)
+		verify(g, live, initFree)
+		moved, done := g.CompactStep(30)
+		require.Equal(t, uint64(0), moved)
+		require.True(t, done)
+	})
+}
+
+func TestGravity_Placement(t *testing.T) {
+	record := func(n int) uint64 { return uint64(n) + headerLen + keyLen }
+	// creates holes of the given data sizes separated by a single byte record
+	setup := func(p PlacementStrategy, holes []int) *Gravity {
+		size := uint64(0)
+		for _, h := range holes {
+			size += record(h) + record(1)
+		}
+		g, _ := NewGravity(make([]byte, size+record(30)), WithPlacement(p))
+		var keys []uint64
+		for _, h := range holes {
+			k, err := g.Write(randBytes(h))
+			require.NoError(t, err)
+			keys = append(keys, k)
+			_, err = g.Write(randBytes(1))
+			require.NoError(t, err)
+		}
+		for _, k := range keys {
+			require.NoError(t, g.Free(k))
+		}
+		return g
+	}
+	holes := []int{20, 5, 60, 10}
+	holeStart := func(i int) uint64 {
+		pos := uint64(0)
+		for _, h := range holes[:i] {
+			pos += record(h) + record(1)
+		}
+		return pos
+	}
+	tests := []struct {
+		name     string
+		p        PlacementStrategy
+		expected []uint64
+	}{
+		// the remainder of the first hole can't fit another record
+		{"first fit", FirstFit{}, []uint64{holeStart(0), holeStart(1)}},
+		{"best fit", BestFit{}, []uint64{holeStart(1), holeStart(3)}},
+		{"worst fit", WorstFit{}, []uint64{holeStart(2), holeStart(2) + record(4)}},
+		// continues from the end of the setup writes
+		{"next fit", &NextFit{}, []uint64{holeStart(4), holeStart(4) + record(4), holeStart(0)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := setup(tt.p, holes)
+			for _, e := range tt.expected {
+				k, err := g.Write(randBytes(4))
+				require.NoError(t, err)
+				pos, _ := g.vmap.load(k)
+				require.Equal(t, e, pos)
+			}
+		})
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name+" merge", func(t *testing.T) {
+			g := setup(tt.p, holes)
+			data := randBytes(int(g.TotalFreeSpace() - record(0)))
+			k, err := g.Write(data)
+			require.NoError(t, err)
+			d, err := g.Read(k)
+			require.NoError(t, err)
+			require.Equal(t, data, d)
+			require.Equal(t, uint64(0), g.TotalFreeSpace())
+		})
+	}
+
+	t.Run("next fit per region", func(t *testing.T) {
+		nf := &NextFit{}
+		g, _ := NewGravity(make([]byte, 200), WithPlacement(nf))
+		require.NoError(t, g.AddRegion(make([]byte, 200)))
+		_, err := g.Write(randBytes(150))
+		require.NoError(t, err)
+		_, err = g.Write(randBytes(150))
+		require.NoError(t, err)
+		// the regions select with their own cursor
+		require.Equal(t, uint64(150), g.fsm.placement.(*NextFit).cursor-record(0))
+		require.Equal(t, uint64(150), g.regions[0].fsm.placement.(*NextFit).cursor-record(0))
+		require.Equal(t, uint64(0), nf.cursor)
+	})
+}
+
 // Scenario:
 // 1. Writer func writes to the memory until itemsToWrite is zero
 // 2. FreeWriter frees every 100th data and writes a new data for every 300th entry
 // 3. No error should happen during any write/free
+func TestGravity_Slab(t *testing.T) {
+	pageSize := uint64(256)
+	pageLen := headerLen + keyLen + pageSize
+	big := []byte(strings.Repeat("b", 200))
+
+	t.Run("slots", func(t *testing.T) {
+		g, _ := NewGravity(make([]byte, 2048), WithSlab(pageSize))
+		live := make(map[uint64]string)
+		for i := 0; i < 12; i++ {
+			s := strings.Repeat("s", i%7+1)
+			k, err := g.Write([]byte(s))
+			require.NoError(t, err)
+			live[k] = s
+		}
+		kb, err := g.Write(big)
+		require.NoError(t, err)
+		live[kb] = string(big)
+
+		// all the small records share a single page of the 16 byte class
+		s := g.Stats()
+		require.Equal(t, uint64(1), s.SlabPages)
+		require.Equal(t, uint64(13), s.Records)
+		require.Equal(t, g.size-pageLen-headerLen-keyLen-uint64(len(big)), s.TotalFreeSpace)
+		require.Equal(t, s.Size, s.LiveBytes+s.HeaderBytes+s.SlabUnusedBytes+s.TotalFreeSpace)
+
+		for k, v := range live {
+			d, err := g.Read(k)
+			require.NoError(t, err)
+			require.Equal(t, v, string(d))
+		}
+		seen := 0
+		g.Iterate(func(pos uint64, key uint64, data []byte) bool {
+			require.Equal(t, live[key], string(data))
+			seen++
+			return true
+		})
+		require.Equal(t, len(live), seen)
+		require.NoError(t, g.Scrub())
+
+		// the page's key isn't exposed
+		_, err = g.Read(g.slab.pages[0].key)
+		require.Equal(t, WrongReadPosition, err)
+		require.Equal(t, WrongReadPosition, g.Free(g.slab.pages[0].key))
+	})
+
+	t.Run("update and free", func(t *testing.T) {
+		g, _ := NewGravity(make([]byte, 2048), WithSlab(pageSize))
+		k1, _ := g.Write([]byte("one"))
+		k2, _ := g.Write([]byte("two"))
+		require.NoError(t, g.Update(k1, []byte("uno")))
+		require.NoError(t, g.Update(k2, []byte(strings.Repeat("2", 20))))
+		require.NoError(t, g.Update(k2, big))
+		d, _ := g.Read(k1)
+		require.Equal(t, "uno", string(d))
+		d, _ = g.Read(k2)
+		require.Equal(t, big, d)
+		require.Equal(t, uint64(1), g.Stats().SlabPages)
+
+		// freeing the last slot of a page releases the page
+		require.NoError(t, g.FreeBatch([]uint64{k1, k2}))
+		require.Equal(t, uint64(0), g.Stats().SlabPages)
+		require.Equal(t, g.size, g.TotalFreeSpace())
+	})
+
+	t.Run("full page", func(t *testing.T) {
+		g, _ := NewGravity(make([]byte, 1024), WithSlab(pageSize))
+		slots := slotsPerPage(pageSize, slotSizes[0])
+		var keys []uint64
+		for i := uint64(0); i <= slots; i++ {
+			k, err := g.Write([]byte("x"))
+			require.NoError(t, err)
+			keys = append(keys, k)
+		}
+		require.Equal(t, uint64(2), g.Stats().SlabPages)
+		require.NoError(t, g.Free(keys[0]))
+		k, err := g.Write([]byte("y"))
+		require.NoError(t, err)
+		require.Equal(t, uint64(2), g.Stats().SlabPages)
+		d, _ := g.Read(k)
+		require.Equal(t, "y", string(d))
+	})
+
+	t.Run("compact and reopen", func(t *testing.T) {
+		mem := make([]byte, 2048)
+		g, _ := NewGravity(mem, WithSlab(pageSize))
+		kb, _ := g.Write(big)
+		k1, _ := g.Write([]byte("small"))
+		k2, _ := g.Write([]byte(strings.Repeat("m", 40)))
+		require.NoError(t, g.Free(kb))
+		g.Compact()
+		d, _ := g.Read(k1)
+		require.Equal(t, "small", string(d))
+
+		o, err := OpenGravity(mem, WithSlab(pageSize))
+		require.NoError(t, err)
+		d, _ = o.Read(k2)
+		require.Equal(t, strings.Repeat("m", 40), string(d))
+		require.Equal(t, g.Stats().SlabPages, o.Stats().SlabPages)
+		k3, err := o.Write([]byte("new"))
+		require.NoError(t, err)
+		require.True(t, k3 > k2)
+		require.NoError(t, o.Free(k1))
+		_, err = o.Read(k1)
+		require.Equal(t, WrongReadPosition, err)
+	})
+
+	t.Run("checksum", func(t *testing.T) {
+		mem := make([]byte, 2048)
+		g, _ := NewGravity(mem, WithSlab(pageSize), WithChecksum())
+		k1, _ := g.Write([]byte("hello world"))
+		k2, _ := g.Write([]byte("updated"))
+		require.NoError(t, g.Update(k2, []byte("in place")))
+		require.Equal(t, uint64(1), g.Stats().SlabPages)
+		require.NoError(t, g.Scrub())
+
+		// flip a data byte of a slot
+		loc, _ := g.vmap.load(k1)
+		_, _, sp, _ := g.slotAt(loc)
+		mem[sp+g.slab.hdr] ^= 0xff
+		_, err := g.Read(k1)
+		require.True(t, errors.Is(err, ChecksumMismatch))
+		d, err := g.Read(k2)
+		require.NoError(t, err)
+		require.Equal(t, "in place", string(d))
+
+		// and a byte of the page's metadata
+		page := g.slab.pages[0]
+		pos, _ := g.vmap.load(page.key)
+		mem[pos+page.hl+1] ^= 0xff
+		err = g.Scrub()
+		var serr *ScrubError
+		require.True(t, errors.As(err, &serr))
+		require.ElementsMatch(t, []uint64{k1, page.key}, serr.Keys())
+		for _, r := range serr.Records {
+			require.Equal(t, ChecksumMismatch, r.Err)
+		}
+	})
+
+	t.Run("slot holding the page's key", func(t *testing.T) {
+		mem := make([]byte, 2048)
+		g, _ := NewGravity(mem, WithSlab(pageSize))
+		k, _ := g.Write([]byte("slot"))
+		loc, _ := g.vmap.load(k)
+		_, _, sp, _ := g.slotAt(loc)
+		binary.LittleEndian.PutUint32(mem[sp+1:], uint32(g.slab.pages[0].key))
+		_, err := OpenGravity(mem, WithSlab(pageSize))
+		require.Equal(t, CorruptedMemory, err)
+
+		// or the key of another slot of the page
+		k2, _ := g.Write([]byte("other"))
+		binary.LittleEndian.PutUint32(mem[sp+1:], uint32(k2))
+		_, err = OpenGravity(mem, WithSlab(pageSize))
+		require.Equal(t, CorruptedMemory, err)
+	})
+
+	t.Run("no space for a page", func(t *testing.T) {
+		// the page can't fit the region at all
+		g, _ := NewGravity(make([]byte, 200), WithSlab(pageSize))
+		k, err := g.Write([]byte("x"))
+		require.NoError(t, err)
+		d, _ := g.Read(k)
+		require.Equal(t, "x", string(d))
+
+		// the page doesn't fit the space left, a record does
+		mem := make([]byte, 512)
+		g, _ = NewGravity(mem, WithSlab(pageSize))
+		_, err = g.Write(make([]byte, 300))
+		require.NoError(t, err)
+		k, err = g.Write([]byte("small"))
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), g.Stats().SlabPages)
+		o, err := OpenGravity(mem, WithSlab(pageSize))
+		require.NoError(t, err)
+		d, _ = o.Read(k)
+		require.Equal(t, "small", string(d))
+		require.NoError(t, o.Update(k, []byte("smaller")))
+		require.NoError(t, o.Free(k))
+	})
+
+	t.Run("page fits the remapped memory", func(t *testing.T) {
+		g, _ := NewGravity(make([]byte, 200), WithSlab(pageSize))
+		require.NoError(t, g.Remap(make([]byte, 1024)))
+		_, err := g.Write([]byte("x"))
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), g.Stats().SlabPages)
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		g, _ := NewGravity(make([]byte, 1<<20), WithSlab(0), WithSuperblock())
+		// slot writes don't need the write lock
+		g.RLock()
+		done := make(chan error)
+		go func() {
+			_, err := g.Write([]byte("slot"))
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("slab write blocked by a reader")
+		}
+		g.RUnlock()
+
+		var wg sync.WaitGroup
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < 300; i++ {
+					s := fmt.Sprint(w, "-", i, strings.Repeat("s", i%100))
+					k, err := g.Write([]byte(s))
+					require.NoError(t, err)
+					d, err := g.Read(k)
+					require.NoError(t, err)
+					require.Equal(t, s, string(d))
+					if i%3 == 0 {
+						require.NoError(t, g.Free(k))
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+		require.Equal(t, uint64(1+8*200), g.Stats().Records)
+		require.NoError(t, g.Scrub())
+	})
+
+	t.Run("keys beyond 32 bits", func(t *testing.T) {
+		mem := make([]byte, 2048)
+		g, _ := NewGravity(mem, WithSlab(pageSize))
+		g.key = 1<<32 - 3
+		live := make(map[uint64]string)
+		for i := 0; i < 4; i++ {
+			s := fmt.Sprint("high", i)
+			k, err := g.Write([]byte(s))
+			require.NoError(t, err)
+			live[k] = s
+		}
+		// the slots of a page share the high bits of their keys
+		require.Equal(t, uint64(2), g.Stats().SlabPages)
+		o, err := OpenGravity(mem, WithSlab(pageSize))
+		require.NoError(t, err)
+		for k, v := range live {
+			d, err := o.Read(k)
+			require.NoError(t, err)
+			require.Equal(t, v, string(d))
+		}
+		require.NoError(t, o.Scrub())
+	})
+}
+
+func TestGravity_Alignment(t *testing.T) {
+	for _, align := range []uint64{8, 16, 64} {
+		t.Run(fmt.Sprint(align), func(t *testing.T) {
+			mem := make([]byte, 4100)
+			g, err := NewGravity(mem, WithAlignment(align), WithSuperblock())
+			require.NoError(t, err)
+			live := make(map[uint64]string)
+			var keys []uint64
+			for i := 0; i < 30; i++ {
+				s := strings.Repeat(string(rune('a'+i%26)), i*3%41+1)
+				k, err := g.Write([]byte(s))
+				require.NoError(t, err)
+				live[k] = s
+				keys = append(keys, k)
+			}
+			for i := 0; i < len(keys); i += 3 {
+				require.NoError(t, g.Free(keys[i]))
+				delete(live, keys[i])
+			}
+			require.NoError(t, g.Update(keys[1], []byte(strings.Repeat("u", 90))))
+			live[keys[1]] = strings.Repeat("u", 90)
+			g.Compact()
+			k, err := g.Write([]byte(strings.Repeat("z", 77)))
+			require.NoError(t, err)
+			live[k] = strings.Repeat("z", 77)
+
+			verify := func(g *Gravity) {
+				n := 0
+				g.Iterate(func(pos uint64, key uint64, data []byte) bool {
+					require.Equal(t, uint64(0), (pos+g.hdrLen)%align)
+					require.Equal(t, live[key], string(data))
+					n++
+					return true
+				})
+				require.Equal(t, len(live), n)
+				s := g.Stats()
+				require.Equal(t, s.Size, s.LiveBytes+s.HeaderBytes+s.PaddingBytes+s.TotalFreeSpace)
+				require.Equal(t, uint64(0), s.TotalFreeSpace%align)
+			}
+			verify(g)
+
+			o, err := OpenGravity(mem)
+			require.NoError(t, err)
+			require.Equal(t, align, o.align)
+			verify(o)
+		})
+	}
+
+	t.Run("buffer", func(t *testing.T) {
+		// the free space following a chunk and the unused part of a flushed chunk stay aligned
+		for _, align := range []uint64{8, 64} {
+			g, err := NewGravity(make([]byte, 64<<10), WithAlignment(align))
+			require.NoError(t, err)
+			b := g.NewBuffer(1000)
+			k1, err := b.Write(make([]byte, 10))
+			require.NoError(t, err)
+			k2, err := g.Write(make([]byte, 3000))
+			require.NoError(t, err)
+			require.NoError(t, b.Flush())
+			k3, err := g.Write(make([]byte, 500))
+			require.NoError(t, err)
+			for _, k := range []uint64{k1, k2, k3} {
+				pos, _ := g.vmap.load(k)
+				h, ok := g.recordAt(pos)
+				require.True(t, ok)
+				require.Equal(t, uint64(0), (pos+h.hl)%align)
+			}
+		}
+	})
+
+	_, err := NewGravity(make([]byte, 100), WithAlignment(12))
+	require.Error(t, err)
+}
+
+func TestGravity_CompactHeaders(t *testing.T) {
+	fill := func(g *Gravity) map[uint64]string {
+		live := make(map[uint64]string)
+		for i := 0; ; i++ {
+			s := fmt.Sprint("v", i)
+			k, err := g.Write([]byte(s))
+			if err == NotEnoughSpace {
+				return live
+			}
+			require.NoError(t, err)
+			live[k] = s
+		}
+	}
+	fixed, _ := NewGravity(make([]byte, 1024))
+	g, _ := NewGravity(make([]byte, 1024), WithCompactHeaders())
+	require.True(t, len(fill(g)) > 2*len(fill(fixed)))
+
+	mem := make([]byte, 4096)
+	g, err := NewGravity(mem, WithCompactHeaders(), WithChecksum(), WithSuperblock())
+	require.NoError(t, err)
+	live := make(map[uint64]string)
+	var keys []uint64
+	for i := 0; i < 150; i++ {
+		s := strings.Repeat("x", i%30)
+		k, err := g.Write([]byte(s))
+		require.NoError(t, err)
+		live[k] = s
+		keys = append(keys, k)
+	}
+	for i := 0; i < len(keys); i += 2 {
+		require.NoError(t, g.Free(keys[i]))
+		delete(live, keys[i])
+	}
+	// requires merging the free spaces
+	big := strings.Repeat("b", 1000)
+	k, err := g.Write([]byte(big))
+	require.NoError(t, err)
+	live[k] = big
+	require.NoError(t, g.Update(keys[1], []byte("short")))
+	live[keys[1]] = "short"
+
+	verify := func(g *Gravity) {
+		for k, v := range live {
+			d, err := g.Read(k)
+			require.NoError(t, err)
+			require.Equal(t, v, string(d))
+		}
+		require.NoError(t, g.Scrub())
+		s := g.Stats()
+		require.Equal(t, uint64(len(live)), s.Records)
+		require.Equal(t, s.Size, s.LiveBytes+s.HeaderBytes+s.TotalFreeSpace)
+	}
+	verify(g)
+	o, err := OpenGravity(mem)
+	require.NoError(t, err)
+	verify(o)
+
+	_, err = NewGravity(make([]byte, 1024), WithCompactHeaders(), WithAlignment(8))
+	require.Error(t, err)
+}
+
+func TestGravity_Region(t *testing.T) {
+	g, _ := NewGravity(make([]byte, 200))
+	live := make(map[uint64]string)
+	write := func(s string) uint64 {
+		k, err := g.Write([]byte(s))
+		require.NoError(t, err)
+		live[k] = s
+		return k
+	}
+	var keys []uint64
+	for i := 0; i < 9; i++ {
+		keys = append(keys, write(fmt.Sprint("first", i)))
+	}
+	_, err := g.Write([]byte("overflow"))
+	require.Equal(t, NotEnoughSpace, err)
+
+	require.NoError(t, g.AddRegion(make([]byte, 300)))
+	require.Equal(t, 2, g.Regions())
+	for i := 0; i < 4; i++ {
+		keys = append(keys, write(fmt.Sprint("second", i)))
+	}
+
+	// the record grows beyond its own region and is moved to the new one
+	require.NoError(t, g.Update(keys[0], []byte(strings.Repeat("u", 40))))
+	live[keys[0]] = strings.Repeat("u", 40)
+	require.NoError(t, g.Free(keys[9]))
+	delete(live, keys[9])
+	require.NoError(t, g.FreeBatch([]uint64{keys[1], keys[10]}))
+	delete(live, keys[1])
+	delete(live, keys[10])
+
+	bkeys, err := g.WriteBatch([][]byte{[]byte("batch0"), []byte("batch1")})
+	require.NoError(t, err)
+	live[bkeys[0]], live[bkeys[1]] = "batch0", "batch1"
+	r, err := g.Reserve(4)
+	require.NoError(t, err)
+	copy(r.Bytes(), "resv")
+	k, err := r.Commit()
+	require.NoError(t, err)
+	live[k] = "resv"
+
+	verify := func() {
+		for k, v := range live {
+			d, err := g.Read(k)
+			require.NoError(t, err)
+			require.Equal(t, v, string(d))
+		}
+		n := 0
+		g.Iterate(func(pos uint64, key uint64, data []byte) bool {
+			require.Equal(t, live[key], string(data))
+			n++
+			return true
+		})
+		require.Equal(t, len(live), n)
+		require.NoError(t, g.Scrub())
+		s := g.Stats()
+		require.Equal(t, uint64(500), s.Size)
+		require.Equal(t, uint64(len(live)), s.Records)
+		require.Equal(t, s.Size, s.LiveBytes+s.HeaderBytes+s.TotalFreeSpace)
+		require.Equal(t, s.TotalFreeSpace, g.TotalFreeSpace())
+	}
+	verify()
+	g.Compact()
+	verify()
+	require.Equal(t, uint64(2), g.Stats().FreeSpaces)
+	_, err = g.Read(keys[9])
+	require.Equal(t, WrongReadPosition, err)
+
+	t.Run("write context", func(t *testing.T) {
+		g, _ := NewGravity(make([]byte, 64))
+		_, err := g.Write(make([]byte, 40))
+		require.NoError(t, err)
+		done := make(chan error)
+		go func() {
+			_, err := g.WriteContext(context.Background(), make([]byte, 20))
+			done <- err
+		}()
+		time.Sleep(10 * time.Millisecond)
+		require.NoError(t, g.AddRegion(make([]byte, 64)))
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("writer wasn't woken up by the new region")
+		}
+	})
+}
+
+func TestGravity_Grow(t *testing.T) {
+	var mem []byte
+	var released int
+	grow := func(size uint64) ([]byte, error) {
+		mem = make([]byte, 2*size)
+		return mem, nil
+	}
+	g, err := NewGravity(make([]byte, 128), WithSuperblock(), WithChecksum(), WithGrow(grow, func(old []byte) {
+		released++
+	}))
+	require.NoError(t, err)
+	live := make(map[uint64]string)
+	var keys []uint64
+	for i := 0; i < 50; i++ {
+		s := fmt.Sprint("record", i)
+		k, err := g.Write([]byte(s))
+		require.NoError(t, err)
+		live[k] = s
+		keys = append(keys, k)
+	}
+	require.NoError(t, g.Free(keys[3]))
+	delete(live, keys[3])
+	big := strings.Repeat("u", 2000)
+	require.NoError(t, g.Update(keys[4], []byte(big)))
+	live[keys[4]] = big
+	bkeys, err := g.WriteBatch([][]byte{make([]byte, 3000), make([]byte, 10)})
+	require.NoError(t, err)
+	live[bkeys[0]], live[bkeys[1]] = string(make([]byte, 3000)), string(make([]byte, 10))
+
+	s := g.Stats()
+	require.True(t, s.Grows >= 5)
+	require.Equal(t, int(s.Grows), released)
+	require.Equal(t, uint64(len(mem))-superblockLen, s.Size)
+	for k, v := range live {
+		d, err := g.Read(k)
+		require.NoError(t, err)
+		require.Equal(t, v, string(d))
+	}
+	require.NoError(t, g.Scrub())
+
+	o, err := OpenGravity(mem)
+	require.NoError(t, err)
+	for k, v := range live {
+		d, err := o.Read(k)
+		require.NoError(t, err)
+		require.Equal(t, v, string(d))
+	}
+
+	t.Run("declined", func(t *testing.T) {
+		g, _ := NewGravity(make([]byte, 64), WithGrow(func(uint64) ([]byte, error) {
+			return nil, nil
+		}, nil))
+		_, err := g.Write(make([]byte, 64))
+		require.Equal(t, NotEnoughSpace, err)
+
+		failed := errors.New("failed")
+		g, _ = NewGravity(make([]byte, 64), WithGrow(func(uint64) ([]byte, error) {
+			return nil, failed
+		}, nil))
+		_, err = g.Write(make([]byte, 64))
+		require.Equal(t, failed, err)
+	})
+}
+
+func TestGravity_Remap(t *testing.T) {
+	buf := make([]byte, 1024)
+	g, err := NewGravity(buf[:256], WithSuperblock())
+	require.NoError(t, err)
+	k1, err := g.Write([]byte("first"))
+	require.NoError(t, err)
+	_, err = g.Write(make([]byte, 300))
+	require.Equal(t, NotEnoughSpace, err)
+
+	// growing adds the new memory as free space
+	require.NoError(t, g.Remap(buf))
+	k2, err := g.Write(make([]byte, 300))
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(buf))-superblockLen, g.Stats().Size)
+
+	// shrinking requires the end of the memory to be free
+	require.Equal(t, NotFree, g.Remap(buf[:256]))
+	require.NoError(t, g.Free(k2))
+	require.NoError(t, g.Remap(buf[:256]))
+	require.Equal(t, uint64(256)-superblockLen, g.Stats().Size)
+	_, err = g.Write(make([]byte, 300))
+	require.Equal(t, NotEnoughSpace, err)
+
+	o, err := OpenGravity(buf[:256])
+	require.NoError(t, err)
+	d, err := o.Read(k1)
+	require.NoError(t, err)
+	require.Equal(t, "first", string(d))
+	require.Equal(t, g.TotalFreeSpace(), o.TotalFreeSpace())
+}
+
+func TestGravity_Journal(t *testing.T) {
+	type crash struct{}
+	// the small journal logs the moves in chunks of 40 bytes
+	journalLen := minJournalLen + 64
+	setup := func() (*Gravity, []byte, map[uint64]string) {
+		mem := make([]byte, 4096)
+		g, err := NewGravity(mem, WithSuperblock(), WithChecksum(), WithJournal(journalLen))
+		require.NoError(t, err)
+		live := make(map[uint64]string)
+		var keys []uint64
+		for i := 0; i < 40; i++ {
+			s := strings.Repeat(string(rune('a'+i%26)), 10+i)
+			k, err := g.Write([]byte(s))
+			require.NoError(t, err)
+			live[k] = s
+			keys = append(keys, k)
+		}
+		for i := 0; i < len(keys); i += 3 {
+			require.NoError(t, g.Free(keys[i]))
+			delete(live, keys[i])
+		}
+		return g, mem, live
+	}
+	verify := func(mem []byte, live map[uint64]string, free uint64) {
+		o, err := OpenGravity(mem)
+		require.NoError(t, err)
+		require.NotNil(t, o.journal)
+		require.Equal(t, free, o.TotalFreeSpace())
+		for k, v := range live {
+			d, err := o.Read(k)
+			require.NoError(t, err)
+			require.Equal(t, v, string(d))
+		}
+		require.NoError(t, o.Scrub())
+		o.Compact()
+		require.True(t, o.compacted())
+		for k, v := range live {
+			d, err := o.Read(k)
+			require.NoError(t, err)
+			require.Equal(t, v, string(d))
+		}
+	}
+
+	// crash at every step of the compaction and recover on open
+	for n := 0; ; n++ {
+		g, mem, live := setup()
+		free := g.TotalFreeSpace()
+		steps := 0
+		var last journalStep
+		g.journal.crash = func(step journalStep) {
+			if steps == n {
+				last = step
+				panic(crash{})
+			}
+			steps++
+		}
+		crashed := func() (crashed bool) {
+			defer func() {
+				if r := recover(); r != nil {
+					require.Equal(t, crash{}, r)
+					crashed = true
+				}
+			}()
+			g.Compact()
+			return false
+		}()
+		if !crashed {
+			require.True(t, n > 20)
+			verify(mem, live, free)
+			break
+		}
+
+		if last == journalChunkLogged {
+			// a torn log of the chunk is discarded, the chunk before it is redone instead
+			torn := append([]byte(nil), mem...)
+			j := g.journal
+			s0, s1 := torn[j.slot(0):], torn[j.slot(1):]
+			s := s0
+			if binary.LittleEndian.Uint64(s1) > binary.LittleEndian.Uint64(s0) {
+				s = s1
+			}
+			s[journalSlotLen] ^= 0xff
+			verify(torn, live, free)
+		}
+		verify(mem, live, free)
+	}
+
+	t.Run("regions", func(t *testing.T) {
+		g, err := NewGravity(make([]byte, 8192), WithSuperblock(), WithJournal(0))
+		require.NoError(t, err)
+		require.Equal(t, superblockLen+defaultJournalLen, g.base)
+		require.NoError(t, g.AddRegion(make([]byte, 128)))
+		require.Nil(t, g.regions[0].journal)
+		_, err = NewGravity(make([]byte, 512), WithJournal(minJournalLen-1))
+		require.Error(t, err)
+	})
+}
+
+func TestGravity_Snapshot(t *testing.T) {
+	g, err := NewGravity(make([]byte, 2048), WithSuperblock())
+	require.NoError(t, err)
+	require.NoError(t, g.AddRegion(make([]byte, 512)))
+	live := make(map[uint64]string)
+	var keys []uint64
+	for i := 0; i < 40; i++ {
+		s := strings.Repeat(fmt.Sprint(i), i%10+1)
+		k, err := g.Write([]byte(s))
+		require.NoError(t, err)
+		live[k] = s
+		keys = append(keys, k)
+	}
+	for i := 0; i < len(keys); i += 4 {
+		require.NoError(t, g.Free(keys[i]))
+		delete(live, keys[i])
+	}
+	var buf bytes.Buffer
+	require.NoError(t, g.Snapshot(&buf))
+	snap := buf.Bytes()
+
+	// the records are restored compactly with their keys, even with a different layout
+	o, err := Restore(bytes.NewReader(snap), make([]byte, 2048), WithSuperblock(), WithChecksum(), WithSlab(256))
+	require.NoError(t, err)
+	require.True(t, o.compacted())
+	for k, v := range live {
+		d, err := o.Read(k)
+		require.NoError(t, err)
+		require.Equal(t, v, string(d))
+	}
+	require.NoError(t, o.Scrub())
+	_, err = o.Read(keys[0])
+	require.Error(t, err)
+	k, err := o.Write([]byte("next"))
+	require.NoError(t, err)
+	require.True(t, k > keys[len(keys)-1])
+
+	t.Run("invalid", func(t *testing.T) {
+		corrupted := append([]byte(nil), snap...)
+		corrupted[snapshotHeaderLen+5] ^= 0xff
+		_, err := Restore(bytes.NewReader(corrupted), make([]byte, 2048))
+		require.Error(t, err)
+
+		_, err = Restore(bytes.NewReader(snap[:len(snap)-20]), make([]byte, 2048))
+		require.Equal(t, io.ErrUnexpectedEOF, err)
+
+		version := append([]byte(nil), snap...)
+		version[8]++
+		_, err = Restore(bytes.NewReader(version), make([]byte, 2048))
+		require.Equal(t, IncompatibleFormat, err)
+
+		_, err = Restore(bytes.NewReader(snap), make([]byte, 256))
+		require.Equal(t, NotEnoughSpace, err)
+	})
+}
+
+func TestGravity_ConcurrentWrite(t *testing.T) {
+	g, err := NewGravity(make([]byte, 1<<20), WithSuperblock(), WithChecksum())
+	require.NoError(t, err)
+
+	// writes that fit don't need the write lock
+	g.RLock()
+	done := make(chan uint64)
+	go func() {
+		k, err := g.Write([]byte("concurrent"))
+		require.NoError(t, err)
+		done <- k
+	}()
+	var key uint64
+	select {
+	case key = <-done:
+	case <-time.After(time.Second):
+		t.Fatal("write blocked by a reader")
+	}
+	g.RUnlock()
+	d, err := g.Read(key)
+	require.NoError(t, err)
+	require.Equal(t, "concurrent", string(d))
+
+	// neither do updates and frees
+	g.RLock()
+	go func() {
+		require.NoError(t, g.Update(key, []byte(strings.Repeat("updated", 20))))
+		k, err := g.Write([]byte("freed"))
+		require.NoError(t, err)
+		require.NoError(t, g.Free(k))
+		done <- k
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("update or free blocked by a reader")
+	}
+	g.RUnlock()
+
+	// writers, readers, iteration and frees interleave
+	var wg sync.WaitGroup
+	var written sync.Map
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				s := fmt.Sprint(w, "-", i, strings.Repeat("x", i%50))
+				k, err := g.Write([]byte(s))
+				require.NoError(t, err)
+				d, err := g.Read(k)
+				require.NoError(t, err)
+				require.Equal(t, s, string(d))
+				if i%5 == 0 {
+					require.NoError(t, g.Free(k))
+					continue
+				}
+				written.Store(k, s)
+			}
+		}(w)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			g.Iterate(func(pos uint64, key uint64, data []byte) bool {
+				return true
+			})
+		}
+	}()
+	wg.Wait()
+
+	count := 0
+	written.Range(func(k, v interface{}) bool {
+		d, err := g.Read(k.(uint64))
+		require.NoError(t, err)
+		require.Equal(t, v.(string), string(d))
+		count++
+		return true
+	})
+	require.Equal(t, 8*160, count)
+	require.NoError(t, g.Scrub())
+	sb, err := ReadSuperblock(g.mem)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, sb.Key, atomic.LoadUint64(&g.key))
+}
+
+func TestGravity_ConcurrentUpdate(t *testing.T) {
+	g, err := NewGravity(make([]byte, 1<<16), WithSlab(0))
+	require.NoError(t, err)
+	keys := make([]uint64, 32)
+	for i := range keys {
+		keys[i], err = g.Write([]byte(fmt.Sprint(i, ":")))
+		require.NoError(t, err)
+	}
+
+	// the updated keys move between slab slots and records while being read, they are never missing
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				j := w*8 + i%8
+				d := fmt.Sprint(j, ":", strings.Repeat("u", i*7%200))
+				require.NoError(t, g.Update(keys[j], []byte(d)))
+			}
+		}(w)
+	}
+	var readers sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for i, k := range keys {
+					d, err := g.Read(k)
+					require.NoError(t, err)
+					require.True(t, strings.HasPrefix(string(d), fmt.Sprint(i, ":")))
+				}
+			}
+		}()
+	}
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for i := 0; i < 300; i++ {
+			k, err := g.Write([]byte(strings.Repeat("f", i%150)))
+			require.NoError(t, err)
+			require.NoError(t, g.Free(k))
+			_, err = g.Read(k)
+			require.Equal(t, WrongReadPosition, err)
+		}
+	}()
+	wg.Wait()
+	close(stop)
+	readers.Wait()
+	require.Equal(t, uint64(len(keys)), g.Stats().Records)
+	require.NoError(t, g.Scrub())
+}
+
+func TestGravity_ReadDuringCompaction(t *testing.T) {
+	g, err := NewGravity(make([]byte, 1<<16), WithSuperblock(), WithJournal(0), WithIndexShards(256))
+	require.NoError(t, err)
+	live := make(map[uint64]string)
+	var keys []uint64
+	for i := 0; i < 100; i++ {
+		s := fmt.Sprint("record", i, strings.Repeat("r", i))
+		k, err := g.Write([]byte(s))
+		require.NoError(t, err)
+		live[k] = s
+		keys = append(keys, k)
+	}
+	for i := 0; i < len(keys); i += 2 {
+		require.NoError(t, g.Free(keys[i]))
+		delete(live, keys[i])
+	}
+
+	// pause the compaction once it starts moving the first record
+	paused, resume := make(chan uint64), make(chan struct{})
+	g.journal.crash = func(step journalStep) {
+		if step == journalBegun && paused != nil {
+			h, _ := g.recordAt(binary.LittleEndian.Uint64(g.mem[g.journal.start+jSrcOffset:]))
+			paused <- h.key
+			paused = nil
+			<-resume
+		}
+	}
+	compacted := make(chan struct{})
+	go func() {
+		g.Compact()
+		close(compacted)
+	}()
+	moving := <-paused
+
+	// only the read of the record being moved waits
+	for k, v := range live {
+		if g.vmap.shardOf(k) == g.vmap.shardOf(moving) {
+			continue
+		}
+		d, err := g.Read(k)
+		require.NoError(t, err)
+		require.Equal(t, v, string(d))
+	}
+	read := make(chan []byte)
+	go func() {
+		d, err := g.Read(moving)
+		require.NoError(t, err)
+		read <- d
+	}()
+	select {
+	case <-read:
+		t.Fatal("read of the record being moved didn't wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(resume)
+	require.Equal(t, live[moving], string(<-read))
+	<-compacted
+	require.True(t, g.compacted())
+
+	// readers run against repeated compactions, reading the records that aren't freed meanwhile
+	stable := make(map[uint64]string)
+	for _, k := range keys[41:] {
+		if v, ok := live[k]; ok {
+			stable[k] = v
+		}
+	}
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for k, v := range stable {
+					d, err := g.Read(k)
+					require.NoError(t, err)
+					require.Equal(t, v, string(d))
+				}
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		k, err := g.Write([]byte(fmt.Sprint("temp", i)))
+		require.NoError(t, err)
+		require.NoError(t, g.Free(keys[1+i*2]))
+		require.NoError(t, g.Free(k))
+		g.Compact()
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestGravity_Buffer(t *testing.T) {
+	g, err := NewGravity(make([]byte, 1<<16), WithSuperblock(), WithChecksum())
+	require.NoError(t, err)
+	size := g.Stats().Size
+
+	b := g.NewBuffer(1024)
+	k1, err := b.Write([]byte("buffered"))
+	require.NoError(t, err)
+	s := g.Stats()
+	require.Equal(t, 1024-g.recordLen(8, k1), s.BufferedBytes)
+	require.Equal(t, uint64(1), s.Writes)
+	require.Equal(t, size, s.LiveBytes+s.HeaderBytes+s.PaddingBytes+s.TotalFreeSpace)
+	require.Equal(t, size-g.recordLen(8, k1), g.TotalFreeSpace())
+
+	// records are bumped one after the other within the chunk, taking only the lock of the buffer
+	g.Lock()
+	g.placing.Lock()
+	done := make(chan uint64)
+	go func() {
+		k, err := b.Write([]byte("next"))
+		require.NoError(t, err)
+		done <- k
+	}()
+	var k2 uint64
+	select {
+	case k2 = <-done:
+	case <-time.After(time.Second):
+		t.Fatal("buffered write blocked by the write lock")
+	}
+	g.placing.Unlock()
+	g.Unlock()
+	require.Equal(t, k1+1, k2)
+	require.Equal(t, uint64(2), g.Stats().Writes)
+	p1, _ := g.vmap.load(k1)
+	p2, _ := g.vmap.load(k2)
+	require.Equal(t, p1+g.recordLen(8, k1), p2)
+
+	// records larger than the chunk are written like Write
+	big, err := b.Write(make([]byte, 2000))
+	require.NoError(t, err)
+	require.Equal(t, 1024-g.recordLen(8, k1)-g.recordLen(4, k2), g.Stats().BufferedBytes)
+
+	require.NoError(t, b.Flush())
+	require.Equal(t, uint64(0), g.Stats().BufferedBytes)
+	require.NoError(t, g.Scrub())
+	o, err := OpenGravity(g.mem)
+	require.NoError(t, err)
+	for k, v := range map[uint64]string{k1: "buffered", k2: "next", big: string(make([]byte, 2000))} {
+		d, err := o.Read(k)
+		require.NoError(t, err)
+		require.Equal(t, v, string(d))
+	}
+	require.Equal(t, g.TotalFreeSpace(), o.TotalFreeSpace())
+
+	// moving records reclaims the chunks
+	_, err = b.Write([]byte("again"))
+	require.NoError(t, err)
+	require.NoError(t, g.Free(k1))
+	g.Compact()
+	require.True(t, g.compacted())
+	require.Equal(t, uint64(0), g.Stats().BufferedBytes)
+	require.NoError(t, b.Close())
+	_, err = b.Write([]byte("closed"))
+	require.Equal(t, BufferClosed, err)
+
+	t.Run("parallel", func(t *testing.T) {
+		g, err := NewGravity(make([]byte, 1<<20))
+		require.NoError(t, err)
+		var wg sync.WaitGroup
+		var written sync.Map
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				b := g.NewBuffer(0)
+				defer b.Close()
+				for i := 0; i < 300; i++ {
+					s := fmt.Sprint(w, "-", i, strings.Repeat("b", i%40))
+					k, err := b.Write([]byte(s))
+					require.NoError(t, err)
+					if i%7 == 0 {
+						require.NoError(t, g.Free(k))
+						continue
+					}
+					written.Store(k, s)
+					if i%100 == 0 {
+						g.CompactStep(4096)
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+		require.Equal(t, uint64(0), g.Stats().BufferedBytes)
+		written.Range(func(k, v interface{}) bool {
+			d, err := g.Read(k.(uint64))
+			require.NoError(t, err)
+			require.Equal(t, v.(string), string(d))
+			return true
+		})
+	})
+}
+
+func TestGravity_Sharded(t *testing.T) {
+	mem := make([]byte, 4*1024)
+	sg, err := NewShardedGravity(SplitMemory(mem, 4), nil, WithSuperblock())
+	require.NoError(t, err)
+	require.Equal(t, 4, sg.Shards())
+
+	// round robin spreads the writes over the shards
+	live := make(map[uint64]string)
+	perShard := make(map[uint64]int)
+	for i := 0; i < 40; i++ {
+		s := fmt.Sprint("sharded", i)
+		k, err := sg.Write([]byte(s))
+		require.NoError(t, err)
+		live[k] = s
+		perShard[k>>shardShift]++
+	}
+	require.Equal(t, map[uint64]int{0: 10, 1: 10, 2: 10, 3: 10}, perShard)
+
+	k, err := sg.WriteHint(6, []byte("hinted"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), k>>shardShift)
+	live[k] = "hinted"
+	require.NoError(t, sg.Update(k, []byte("hinted and updated")))
+	live[k] = "hinted and updated"
+	for k, v := range live {
+		d, err := sg.Read(k)
+		require.NoError(t, err)
+		require.Equal(t, v, string(d))
+	}
+	require.NoError(t, sg.Free(k))
+	delete(live, k)
+	_, err = sg.Read(k)
+	require.Error(t, err)
+	_, err = sg.Read(uint64(5) << shardShift)
+	require.Equal(t, WrongReadPosition, err)
+
+	s := sg.Stats()
+	require.Equal(t, uint64(len(live)), s.Records)
+	require.Equal(t, 4*(1024-superblockLen), s.Size)
+	require.Equal(t, s.TotalFreeSpace, sg.TotalFreeSpace())
+	count := 0
+	sg.Iterate(func(pos uint64, key uint64, data []byte) bool {
+		require.Equal(t, live[key], string(data))
+		count++
+		return true
+	})
+	require.Equal(t, len(live), count)
+
+	// a full shard overflows to the next one
+	for _, id := range []uint64{1, 2} {
+		k, err = sg.WriteHint(1, make([]byte, 600))
+		require.NoError(t, err)
+		require.Equal(t, id, k>>shardShift)
+		live[k] = string(make([]byte, 600))
+	}
+
+	// a write fitting no shard fails once
+	_, err = sg.Write(make([]byte, 2000))
+	require.Equal(t, NotEnoughSpace, err)
+	require.Equal(t, uint64(1), sg.Stats().NotEnoughSpaceErrors)
+
+	// least loaded picks the shard with the most free space
+	o, err := OpenShardedGravity(SplitMemory(mem, 4), LeastLoaded{})
+	require.NoError(t, err)
+	for k, v := range live {
+		d, err := o.Read(k)
+		require.NoError(t, err)
+		require.Equal(t, v, string(d))
+	}
+	for _, g := range o.shards {
+		require.Equal(t, g.TotalFreeSpace(), g.freeEstimate())
+	}
+	k, err = o.Write([]byte("least loaded"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), k>>shardShift)
+
+	t.Run("placement per shard", func(t *testing.T) {
+		sg, err := NewShardedGravity(SplitMemory(make([]byte, 1024), 2), nil, WithPlacement(&NextFit{}))
+		require.NoError(t, err)
+		for i := 0; i < 2; i++ {
+			_, err = sg.Write(randBytes(100))
+			require.NoError(t, err)
+		}
+		// the shards select with their own cursor
+		for _, g := range sg.shards {
+			require.Equal(t, 100+headerLen+keyLen, g.fsm.placement.(*NextFit).cursor)
+		}
+	})
+
+	t.Run("parallel", func(t *testing.T) {
+		sg, err := NewShardedGravity(SplitMemory(make([]byte, 1<<20), 8), nil)
+		require.NoError(t, err)
+		var wg sync.WaitGroup
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < 200; i++ {
+					s := fmt.Sprint(w, "-", i)
+					k, err := sg.Write([]byte(s))
+					require.NoError(t, err)
+					d, err := sg.Read(k)
+					require.NoError(t, err)
+					require.Equal(t, s, string(d))
+					if i%3 == 0 {
+						require.NoError(t, sg.Free(k))
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+		require.Equal(t, uint64(8*200-8*67), sg.Stats().Records)
+	})
+
+	_, err = NewShardedGravity(nil, nil)
+	require.Error(t, err)
+}
+
 func TestGravity_WriteFreeParallel(t *testing.T) {
 	memSize := 160000
 	g, _ := NewGravity(make([]byte, memSize))
@@ -558,6 +2597,44 @@ func BenchmarkGravity_Expand(b *testing.B) {
 	}
 }
 
+func BenchmarkGravity_Placement(b *testing.B) {
+	strategies := []struct {
+		name string
+		p    func() PlacementStrategy
+	}{
+		{"gravity", func() PlacementStrategy { return GravityFit{} }},
+		{"first fit", func() PlacementStrategy { return FirstFit{} }},
+		{"best fit", func() PlacementStrategy { return BestFit{} }},
+		{"worst fit", func() PlacementStrategy { return WorstFit{} }},
+		{"next fit", func() PlacementStrategy { return &NextFit{} }},
+	}
+	for _, s := range strategies {
+		b.Run(s.name, func(b *testing.B) {
+			g, _ := NewGravity(make([]byte, 1<<20), WithPlacement(s.p()))
+			r := rand.New(rand.NewSource(1))
+			var keys []uint64
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				k, err := g.Write(randBytes(r.Intn(200) + 20))
+				if err == nil {
+					keys = append(keys, k)
+				}
+				// free a random key every other write
+				if i%2 == 0 && len(keys) > 0 {
+					j := r.Intn(len(keys))
+					_ = g.Free(keys[j])
+					keys[j] = keys[len(keys)-1]
+					keys = keys[:len(keys)-1]
+				}
+			}
+			b.StopTimer()
+			st := g.Stats()
+			b.ReportMetric(st.Fragmentation, "fragmentation")
+			b.ReportMetric(float64(st.BytesMoved)/float64(b.N), "moved/op")
+		})
+	}
+}
+
 func writer(g *Gravity, maxCount int) chan []byte {
 	writerWorkers := 10
 	ch := make(chan []byte, writerWorkers)
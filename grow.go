@@ -0,0 +1,113 @@
+package gravity
+
+import (
+	"errors"
+	"ohalloc/treap"
+	"sync/atomic"
+)
+
+var (
+	NotFree = errors.New("memory beyond the new size is not free")
+)
+
+// GrowFunc returns a larger memory to migrate the records to when the memory of size currentSize is full.
+// Returning a nil memory without an error declines growing, in which case the write fails with NotEnoughSpace
+type GrowFunc func(currentSize uint64) ([]byte, error)
+
+// grow migrates the records of the Gravity's own memory compactly to the memory obtained from the grow option
+// so that at least size more bytes fit in it. Keys stay valid as only the positions in vmap change.
+// The old memory (or the new memory, if it's too small) is handed over to the release option. The memory isn't
+// grown while reservations are open as their data is being written to it
+func (g *Gravity) grow(size uint64) error {
+	if g.opts.grow == nil || g.reserving() {
+		return NotEnoughSpace
+	}
+	g.reclaim()
+	mem, err := g.opts.grow(uint64(len(g.mem)))
+	if err != nil {
+		return err
+	}
+	if mem == nil {
+		return NotEnoughSpace
+	}
+	n, err := newGravity(mem, g.opts)
+	if err != nil || n.size-n.base < g.size-g.base-g.fsm.totalFreeSpaceSize()+size {
+		g.releaseMem(mem)
+		return NotEnoughSpace
+	}
+
+	// copy the superblock and the records, vmap is updated only once all the records are copied
+	copy(mem[:g.base], g.mem[:g.base])
+	type move struct{ key, pos uint64 }
+	var moves []move
+	dst := g.base
+	err = g.scan(g.base, func(s span) bool {
+		if s.free {
+			return true
+		}
+		copy(mem[dst:dst+s.size], g.mem[s.pos:s.pos+s.size])
+		moves = append(moves, move{s.key, dst})
+		dst += s.size
+		return true
+	})
+	if err != nil {
+		g.releaseMem(mem)
+		return err
+	}
+	for _, m := range moves {
+		g.vmap.store(m.key, m.pos)
+	}
+
+	old := g.mem
+	g.mem, g.size = mem, n.size
+	g.slab.arena = n.slab.arena
+	fs := &treap.FreeSpace{Start: dst, End: g.size - 1}
+	g.markFree(fs)
+	g.fsm.reset(fs)
+	atomic.AddUint64(&g.stats.grows, 1)
+	atomic.AddUint64(&g.stats.bytesMoved, dst-g.base)
+	g.releaseMem(old)
+	return nil
+}
+
+func (g *Gravity) releaseMem(mem []byte) {
+	if g.opts.release != nil {
+		g.opts.release(mem)
+	}
+}
+
+// Remap switches the Gravity over to mem holding the same contents as the current memory, for ex. a larger or
+// smaller mapping of the same file. The space added by a larger memory becomes free space. A smaller memory
+// requires the space beyond its size to be free, NotFree is returned otherwise (Compact frees it if the
+// records fit). Slices previously obtained from View or Iterate must not be used once the memory is remapped.
+// ReservationsOpen is returned while reservations are being filled in
+func (g *Gravity) Remap(mem []byte) error {
+	g.Lock()
+	defer g.Unlock()
+	if g.reserving() {
+		return ReservationsOpen
+	}
+	g.reclaim()
+	n, err := newGravity(mem, g.opts)
+	if err != nil {
+		return err
+	}
+	defer func() { g.slab.arena = g.size - g.base }()
+	switch {
+	case n.size > g.size:
+		fs := &treap.FreeSpace{Start: g.size, End: n.size - 1}
+		g.mem, g.size = mem, n.size
+		g.markFree(fs)
+		return g.fsm.add(fs)
+	case n.size < g.size:
+		fs, ok := g.fsm.truncate(g.size-1, n.size-1)
+		if !ok {
+			return NotFree
+		}
+		g.mem, g.size = mem, n.size
+		g.markFree(fs)
+	default:
+		g.mem = mem
+	}
+	return nil
+}
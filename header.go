@@ -0,0 +1,199 @@
+package gravity
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"ohalloc/treap"
+)
+
+// The first headerLen bytes of every record or free space hold a little endian header word whose lowest
+// bits tell them apart when the memory is scanned
+//
+//	record     : bit0 = 0, bits 8-63 = data length. Followed by key, checksum (if enabled), data and
+//	             padding to the alignment (if enabled)
+//	slab page  : a record with bit1 = 1 whose data holds the slots of small records
+//	free space : bit0 = 1, bit1 = 0, bits 2-63 = size of the free space (>= headerLen)
+//	tiny free  : a single byte with bit0 = 1, bit1 = 1, bits 2-7 = size of the free space (< headerLen)
+//	reserved   : a tiny free of size 0 followed by the uvarint of the size of a span reserved for a record
+//	             that isn't committed yet
+//
+// With compact headers, a record instead starts with the uvarint of data length << 2 (bit0 = 0, bit1 = page)
+// followed by the uvarint of the key, making the length of the headers vary between records
+const (
+	freeTag       = uint64(1)
+	tinyTag       = uint64(2)
+	pageTag       = uint64(2)
+	tagBits       = uint64(2)
+	recordLenBits = uint64(8)
+)
+
+var (
+	CorruptedMemory = errors.New("corrupted memory")
+)
+
+// recordHeader is the decoded header of a record
+type recordHeader struct {
+	dl   uint64 // data length of the record
+	key  uint64 // key of the record
+	hl   uint64 // length of the headers preceding the data
+	page bool   // whether the record is a slab page
+}
+
+// span is a record or a free space found while scanning the memory
+type span struct {
+	recordHeader
+	pos      uint64 // start of the span
+	size     uint64 // total bytes covered by the span including the headers
+	free     bool   // whether the span is a free space
+	reserved bool   // whether the free space is reserved for a record that isn't committed yet
+}
+
+// headerLen returns the length of the headers of a record of data length dl and key k
+func (g *Gravity) headerLen(dl uint64, k uint64) uint64 {
+	if !g.opts.compactHeaders {
+		return g.hdrLen
+	}
+	return g.hdrLen + uvarintLen(dl<<tagBits) + uvarintLen(k)
+}
+
+func uvarintLen(x uint64) uint64 {
+	return uint64(bits.Len64(x|1)+6) / 7
+}
+
+// putRecordHeader writes the header of a record of data length dl at pos
+func (g *Gravity) putRecordHeader(pos uint64, dl uint64, k uint64) recordHeader {
+	return g.putHeader(pos, recordHeader{dl: dl, key: k})
+}
+
+// putPageHeader writes the header of a slab page of data length dl at pos
+func (g *Gravity) putPageHeader(pos uint64, dl uint64, k uint64) recordHeader {
+	return g.putHeader(pos, recordHeader{dl: dl, key: k, page: true})
+}
+
+func (g *Gravity) putHeader(pos uint64, h recordHeader) recordHeader {
+	tag := uint64(0)
+	if h.page {
+		tag = pageTag
+	}
+	h.hl = g.headerLen(h.dl, h.key)
+	if g.opts.compactHeaders {
+		n := uint64(binary.PutUvarint(g.mem[pos:], h.dl<<tagBits|tag))
+		binary.PutUvarint(g.mem[pos+n:], h.key)
+		return h
+	}
+	binary.LittleEndian.PutUint64(g.mem[pos:pos+headerLen], h.dl<<recordLenBits|tag)
+	binary.LittleEndian.PutUint64(g.mem[pos+headerLen:pos+headerLen+keyLen], h.key)
+	return h
+}
+
+// recordAt decodes the header of the record at pos. ok is false if pos is not the start of a record
+func (g *Gravity) recordAt(pos uint64) (h recordHeader, ok bool) {
+	if pos >= g.size || g.mem[pos]&byte(freeTag) != 0 {
+		return h, false
+	}
+	var w uint64
+	if g.opts.compactHeaders {
+		var n, m int
+		if w, n = binary.Uvarint(g.mem[pos:g.size]); n <= 0 {
+			return h, false
+		}
+		if h.key, m = binary.Uvarint(g.mem[pos+uint64(n) : g.size]); m <= 0 {
+			return h, false
+		}
+		h.dl = w >> tagBits
+		h.hl = g.hdrLen + uint64(n+m)
+	} else {
+		if pos+g.hdrLen > g.size {
+			return h, false
+		}
+		w = binary.LittleEndian.Uint64(g.mem[pos : pos+headerLen])
+		h.dl = w >> recordLenBits
+		h.key = binary.LittleEndian.Uint64(g.mem[pos+headerLen : pos+headerLen+keyLen])
+		h.hl = g.hdrLen
+	}
+	h.page = w&pageTag != 0
+	return h, pos+h.hl <= g.size && h.dl <= g.size-pos-h.hl
+}
+
+// markFree writes the free space marker at the start of fs
+func (g *Gravity) markFree(fs *treap.FreeSpace) {
+	size := fs.Size()
+	if size == 0 {
+		return
+	}
+	if size < headerLen {
+		g.mem[fs.Start] = byte(size<<tagBits | tinyTag | freeTag)
+		return
+	}
+	binary.LittleEndian.PutUint64(g.mem[fs.Start:fs.Start+headerLen], size<<tagBits|freeTag)
+}
+
+// markReserved writes the marker of a span of size bytes at pos reserved for a record
+func (g *Gravity) markReserved(pos uint64, size uint64) {
+	g.mem[pos] = byte(tinyTag | freeTag)
+	binary.PutUvarint(g.mem[pos+1:], size)
+}
+
+// spanAt decodes the record or free space starting at pos. Zeros following a span till the end of the memory
+// are free space, for ex. the end of a file grown without its free space marker being flushed
+func (g *Gravity) spanAt(pos uint64) (span, error) {
+	s := span{pos: pos}
+	b := uint64(g.mem[pos])
+	switch {
+	case b == 0 && pos > g.base && isZero(g.mem[pos:g.size]):
+		s.free = true
+		s.size = g.size - pos
+	case b == freeTag|tinyTag:
+		size, n := binary.Uvarint(g.mem[pos+1 : g.size])
+		if n <= 0 {
+			return s, CorruptedMemory
+		}
+		s.free, s.reserved, s.size = true, true, size
+	case b&freeTag != 0 && b&tinyTag != 0:
+		s.free = true
+		s.size = b >> tagBits
+	case b&freeTag != 0:
+		if pos+headerLen > g.size {
+			return s, CorruptedMemory
+		}
+		s.free = true
+		s.size = binary.LittleEndian.Uint64(g.mem[pos:pos+headerLen]) >> tagBits
+	default:
+		h, ok := g.recordAt(pos)
+		if !ok {
+			return s, CorruptedMemory
+		}
+		s.recordHeader = h
+		s.size = g.recordLen(h.dl, h.key)
+	}
+	if s.size == 0 || pos+s.size > g.size {
+		return s, CorruptedMemory
+	}
+	return s, nil
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// scan walks every span from start till the end of memory in order and stops when fn returns false
+func (g *Gravity) scan(start uint64, fn func(s span) bool) error {
+	pos := start
+	for pos < g.size {
+		s, err := g.spanAt(pos)
+		if err != nil {
+			return err
+		}
+		if !fn(s) {
+			return nil
+		}
+		pos += s.size
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package gravity
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"ohalloc/treap"
+)
+
+// Journal layout (little endian) reserved after the superblock
+//
+//	[0:8]   sequence of the last logged move
+//	[8:16]  source of the move
+//	[16:24] destination of the move
+//	[24:32] length of the move
+//	[32:36] checksum of [0:32]
+//	[36:40] reserved
+//	[40:]   two chunk slots
+//
+// Chunk slot layout
+//
+//	[0:8]   offset of the chunk in the move
+//	[8:16]  length of the chunk
+//	[16:20] checksum of the sequence, [0:16] and the data
+//	[20:24] reserved
+//	[24:]   data of the chunk
+//
+// A move shifts records towards the start of the memory. It is logged before anything is moved, and is copied
+// in chunks each logged along with its data in alternating slots before being copied, so a chunk partially
+// copied over its own source can always be copied again. The memory vacated by the move is marked free before
+// the journal is cleared, keeping the memory scannable once the move is complete.
+// A move found in the journal on open is finished, while a move whose log is incomplete never started and is
+// discarded
+const (
+	journalHeaderLen  = uint64(40)
+	journalSlotLen    = uint64(24)
+	minJournalLen     = journalHeaderLen + 2*(journalSlotLen+8)
+	defaultJournalLen = uint64(4096)
+
+	jSrcOffset   = 8
+	jDstOffset   = 16
+	jLenOffset   = 24
+	jCrcOffset   = 32
+	jChunkOffset = 8
+	jSlotCrc     = 16
+)
+
+var InvalidJournal = errors.New("invalid journal")
+
+// journalStep identifies the steps of a journaled move, after each of which a crash can be injected
+type journalStep int
+
+const (
+	journalBegun journalStep = iota
+	journalChunkLogged
+	journalChunkCopied
+	journalVacated
+	journalCleared
+)
+
+type journal struct {
+	start    uint64                 // start of the journal in the memory
+	chunkLen uint64                 // largest chunk of a move logged in a slot
+	seq      uint64                 // sequence of the last logged move
+	crash    func(step journalStep) // fault injection hook called after every step of a move
+}
+
+// slot returns the start of the i-th chunk's slot
+func (j *journal) slot(i uint64) uint64 {
+	return j.start + journalHeaderLen + i%2*(journalSlotLen+j.chunkLen)
+}
+
+func (j *journal) step(s journalStep) {
+	if j.crash != nil {
+		j.crash(s)
+	}
+}
+
+// clearJournal zeroes the journal of a new Gravity so that nothing left in the memory is recovered
+func (g *Gravity) clearJournal(length uint64) {
+	b := g.mem[g.journal.start : g.journal.start+length]
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// move shifts the n bytes at src to dst before it, journaling the move if enabled
+func (g *Gravity) move(dst, src, n uint64) {
+	j := g.journal
+	if j == nil {
+		copy(g.mem[dst:dst+n], g.mem[src:src+n])
+		return
+	}
+	j.seq++
+	h := g.mem[j.start : j.start+journalHeaderLen]
+	binary.LittleEndian.PutUint64(h, j.seq)
+	binary.LittleEndian.PutUint64(h[jSrcOffset:], src)
+	binary.LittleEndian.PutUint64(h[jDstOffset:], dst)
+	binary.LittleEndian.PutUint64(h[jLenOffset:], n)
+	binary.LittleEndian.PutUint32(h[jCrcOffset:], crc32.Checksum(h[:jCrcOffset], castagnoli))
+	j.step(journalBegun)
+	g.moveFrom(dst, src, n, 0)
+}
+
+// moveFrom copies the journaled move from offset done onwards, marks the vacated memory free and clears
+// the journal
+func (g *Gravity) moveFrom(dst, src, n, done uint64) {
+	j := g.journal
+	for done < n {
+		c := n - done
+		if c > j.chunkLen {
+			c = j.chunkLen
+		}
+		s := g.mem[j.slot(done/j.chunkLen):]
+		binary.LittleEndian.PutUint64(s, done)
+		binary.LittleEndian.PutUint64(s[jChunkOffset:], c)
+		copy(s[journalSlotLen:journalSlotLen+c], g.mem[src+done:src+done+c])
+		binary.LittleEndian.PutUint32(s[jSlotCrc:], j.slotChecksum(s, c))
+		j.step(journalChunkLogged)
+		copy(g.mem[dst+done:dst+done+c], g.mem[src+done:src+done+c])
+		j.step(journalChunkCopied)
+		done += c
+	}
+	g.markFree(&treap.FreeSpace{Start: dst + n, End: src + n - 1})
+	j.step(journalVacated)
+	h := g.mem[j.start+jSrcOffset : j.start+journalHeaderLen]
+	for i := range h {
+		h[i] = 0
+	}
+	j.step(journalCleared)
+}
+
+// slotChecksum returns the checksum of the slot holding a chunk of length c of the current move
+func (j *journal) slotChecksum(s []byte, c uint64) uint32 {
+	var seq [8]byte
+	binary.LittleEndian.PutUint64(seq[:], j.seq)
+	crc := crc32.Update(0, castagnoli, seq[:])
+	crc = crc32.Update(crc, castagnoli, s[:jSlotCrc])
+	return crc32.Update(crc, castagnoli, s[journalSlotLen:journalSlotLen+c])
+}
+
+// recoverJournal finishes the move found in the journal, if any
+func (g *Gravity) recoverJournal() error {
+	j := g.journal
+	h := g.mem[j.start : j.start+journalHeaderLen]
+	j.seq = binary.LittleEndian.Uint64(h)
+	src := binary.LittleEndian.Uint64(h[jSrcOffset:])
+	dst := binary.LittleEndian.Uint64(h[jDstOffset:])
+	n := binary.LittleEndian.Uint64(h[jLenOffset:])
+	if n == 0 || binary.LittleEndian.Uint32(h[jCrcOffset:]) != crc32.Checksum(h[:jCrcOffset], castagnoli) {
+		return nil
+	}
+	if dst < g.base || dst >= src || src > g.size || n > g.size-src {
+		return InvalidJournal
+	}
+
+	// redo the last logged chunk, its source may be partially overwritten but its data is in the slot
+	done := uint64(0)
+	found := false
+	for i := uint64(0); i < 2; i++ {
+		s := g.mem[j.slot(i):]
+		off := binary.LittleEndian.Uint64(s)
+		c := binary.LittleEndian.Uint64(s[jChunkOffset:])
+		if c == 0 || c > j.chunkLen || off > n-c || off/j.chunkLen%2 != i ||
+			binary.LittleEndian.Uint32(s[jSlotCrc:]) != j.slotChecksum(s, c) {
+			continue
+		}
+		if !found || off >= done {
+			found = true
+			done = off
+		}
+	}
+	if found {
+		s := g.mem[j.slot(done/j.chunkLen):]
+		c := binary.LittleEndian.Uint64(s[jChunkOffset:])
+		copy(g.mem[dst+done:dst+done+c], s[journalSlotLen:journalSlotLen+c])
+		done += c
+	}
+	g.moveFrom(dst, src, n, done)
+	return nil
+}
@@ -0,0 +1,4 @@
+// Package mmap provides a Gravity stored in a memory mapped file (linux only).
+// The records written to the Gravity are written to the file by the kernel and survive the process,
+// Sync flushes them to the disk
+package mmap
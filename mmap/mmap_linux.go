@@ -0,0 +1,193 @@
+//go:build linux
+// +build linux
+
+package mmap
+
+import (
+	"errors"
+	gravity "ohalloc"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	OutOfRange = errors.New("range is outside of the mapped file")
+	Closed     = errors.New("file is closed")
+)
+
+// File is a Gravity over a memory mapped file
+type File struct {
+	*gravity.Gravity
+	mu  sync.RWMutex // guards the mapping against Resize and Close
+	f   *os.File
+	mem []byte
+}
+
+// Create creates (or truncates) the file at path to size bytes, maps it and creates a new Gravity on it
+func Create(path string, size int64, opts ...gravity.Option) (*File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = f.Truncate(size); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return newFile(f, size, gravity.NewGravity, opts)
+}
+
+// Open maps the existing file at path and reopens the Gravity stored in it. The Gravity must have been
+// created with the superblock option (see gravity.OpenGravity)
+func Open(path string, opts ...gravity.Option) (*File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return newFile(f, fi.Size(), gravity.OpenGravity, opts)
+}
+
+func newFile(f *os.File, size int64, open func([]byte, ...gravity.Option) (*gravity.Gravity, error),
+	opts []gravity.Option) (*File, error) {
+	mem, err := mmap(f, size)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	g, err := open(mem, opts...)
+	if err != nil {
+		syscall.Munmap(mem)
+		f.Close()
+		return nil, err
+	}
+	return &File{Gravity: g, f: f, mem: mem}, nil
+}
+
+// Size returns the size of the mapped file
+func (m *File) Size() int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return int64(len(m.mem))
+}
+
+// Sync flushes the entire mapping to the file
+func (m *File) Sync() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.mem == nil {
+		return Closed
+	}
+	return msync(m.mem)
+}
+
+// SyncRange flushes n bytes of the mapping starting at offset off to the file. The range is widened
+// to page boundaries
+func (m *File) SyncRange(off, n int64) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.mem == nil {
+		return Closed
+	}
+	if off < 0 || n < 0 || off+n > int64(len(m.mem)) {
+		return OutOfRange
+	}
+	if n == 0 {
+		return nil
+	}
+	start := off &^ int64(os.Getpagesize()-1)
+	return msync(m.mem[start : off+n])
+}
+
+// Resize changes the size of the file and remaps the Gravity on it. Growing adds free space at the end
+// of the memory. Shrinking requires the end of the memory to be free, Compact before shrinking to free it.
+// Slices previously obtained from the Gravity must not be used after resizing
+func (m *File) Resize(size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.mem == nil {
+		return Closed
+	}
+	old := m.mem
+	if size == int64(len(old)) {
+		return nil
+	}
+	if size < int64(len(old)) {
+		// move off the end of the memory before the file is truncated
+		if err := m.Gravity.Remap(old[:size]); err != nil {
+			return err
+		}
+	}
+	if err := m.f.Truncate(size); err != nil {
+		return err
+	}
+	mem, err := mmap(m.f, size)
+	if err != nil {
+		return err
+	}
+	if err = m.Gravity.Remap(mem); err != nil {
+		syscall.Munmap(mem)
+		if size > int64(len(old)) {
+			// the Gravity stays on the old memory, for ex. while reservations are open
+			m.f.Truncate(int64(len(old)))
+		}
+		return err
+	}
+	m.mem = mem
+	if size > int64(len(old)) {
+		// flush the free space marker written at the old end of the memory (aligned memories end up to a
+		// page before it), a crash before it's flushed leaves zeros which reopen as free space
+		start, end := (len(old)-os.Getpagesize())&^(os.Getpagesize()-1), len(old)+8
+		if start < 0 {
+			start = 0
+		}
+		if end > len(mem) {
+			end = len(mem)
+		}
+		if err = msync(mem[start:end]); err != nil {
+			syscall.Munmap(old)
+			return err
+		}
+	}
+	return syscall.Munmap(old)
+}
+
+// Close flushes the mapping to the file, unmaps it and closes the file. The Gravity must not be used
+// once the file is closed
+func (m *File) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.mem == nil {
+		return Closed
+	}
+	err := msync(m.mem)
+	if uerr := syscall.Munmap(m.mem); err == nil {
+		err = uerr
+	}
+	if cerr := m.f.Close(); err == nil {
+		err = cerr
+	}
+	m.mem = nil
+	return err
+}
+
+func mmap(f *os.File, size int64) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
+
+func msync(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)),
+		syscall.MS_SYNC)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+//go:build linux
+// +build linux
+
+package mmap
+
+import (
+	gravity "ohalloc"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gravity")
+	f, err := Create(path, 4096, gravity.WithSuperblock(), gravity.WithChecksum())
+	require.NoError(t, err)
+	k1, err := f.Write([]byte("persisted"))
+	require.NoError(t, err)
+	_, err = f.Write(make([]byte, 5000))
+	require.Equal(t, gravity.NotEnoughSpace, err)
+	require.NoError(t, f.Sync())
+	require.NoError(t, f.SyncRange(100, 10))
+	require.Equal(t, OutOfRange, f.SyncRange(4000, 100))
+
+	require.NoError(t, f.Resize(16384))
+	require.Equal(t, int64(16384), f.Size())
+	k2, err := f.Write(make([]byte, 5000))
+	require.NoError(t, err)
+	require.Equal(t, gravity.NotFree, f.Resize(4096))
+	require.NoError(t, f.Free(k2))
+	require.NoError(t, f.Resize(8192))
+	require.NoError(t, f.Close())
+	require.Equal(t, Closed, f.Sync())
+
+	f, err = Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	require.Equal(t, int64(8192), f.Size())
+	d, err := f.Read(k1)
+	require.NoError(t, err)
+	require.Equal(t, "persisted", string(d))
+	_, err = f.Read(k2)
+	require.Error(t, err)
+	require.NoError(t, f.Scrub())
+
+	t.Run("zero tail", func(t *testing.T) {
+		// a file grown without flushing the free space marker at the old end
+		path := filepath.Join(t.TempDir(), "gravity")
+		f, err := Create(path, 4096, gravity.WithSuperblock())
+		require.NoError(t, err)
+		k, err := f.Write([]byte("persisted"))
+		require.NoError(t, err)
+		free := f.TotalFreeSpace()
+		require.NoError(t, f.Close())
+		require.NoError(t, os.Truncate(path, 8192))
+
+		f, err = Open(path)
+		require.NoError(t, err)
+		defer f.Close()
+		require.Equal(t, free+4096, f.TotalFreeSpace())
+		d, err := f.Read(k)
+		require.NoError(t, err)
+		require.Equal(t, "persisted", string(d))
+		_, err = f.Write(make([]byte, 6000))
+		require.NoError(t, err)
+		require.NoError(t, f.Scrub())
+	})
+}
@@ -0,0 +1,127 @@
+package gravity
+
+import "math/bits"
+
+// Option configures optional behaviour of Gravity
+type Option func(o *options)
+
+type options struct {
+	superblock bool // reserve a superblock at the start of the memory
+	checksum   bool // store and verify a checksum for every record
+	placement  PlacementStrategy
+	// data length of the slab pages holding small records, 0 if disabled
+	slabPageSize uint64
+	alignment    uint64 // alignment of the record's data, 0 if unaligned
+	// store the length and key of records as uvarints
+	compactHeaders bool
+	// migrate the records to a larger memory when full and release the old memory
+	grow    GrowFunc
+	release func(mem []byte)
+	journal uint64 // length of the journal of the moves, 0 if disabled
+	shards  int    // number of shards of the key index
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{shards: maxBucket}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithSuperblock reserves a superblock at the start of the memory describing the arena.
+// The superblock persists the format and the last issued key so that the arena can be validated
+// and reopened with OpenGravity
+func WithSuperblock() Option {
+	return func(o *options) {
+		o.superblock = true
+	}
+}
+
+// WithPlacement sets the strategy used to select free spaces for writes. GravityFit is used by default
+func WithPlacement(p PlacementStrategy) Option {
+	return func(o *options) {
+		o.placement = p
+	}
+}
+
+// WithChecksum stores a CRC32C checksum in every record's header which is verified on Read and Scrub
+func WithChecksum() Option {
+	return func(o *options) {
+		o.checksum = true
+	}
+}
+
+// WithSlab stores records small enough to fit the largest size class (123 bytes of data) in fixed size slots
+// of slab pages of pageSize bytes instead of individual records. A slot has a 5 byte header in place of the
+// 16 bytes of a record's and is rounded up to one of 12 size classes from 16 to 128 bytes. With WithChecksum
+// every slot also holds its own checksum, adding 4 bytes to both. A record is written when there's no space
+// left for a new page. A pageSize of 0 uses 4096 bytes. WriteBatch and Reserve always write individual
+// records. Memory holding slab pages can be reopened with OpenGravity with or without this option
+func WithSlab(pageSize uint64) Option {
+	return func(o *options) {
+		if pageSize == 0 {
+			pageSize = defaultSlabPageSize
+		}
+		if max := pageMetaLen + bitmapLen(maxSlotsPerPage) + maxSlotsPerPage*slotSizes[0]; pageSize > max {
+			pageSize = max
+		}
+		o.slabPageSize = pageSize
+	}
+}
+
+// WithAlignment aligns the data of every record to align bytes (a power of two between 8 and 4096, for ex. 8, 16 or 64)
+// from the start of the memory. Records are padded to a multiple of the alignment so that they stay aligned as
+// they are moved. Aligning the memory itself (mmap regions are page aligned) makes the data safe for atomic
+// operations or overlays. Slab records are not aligned
+func WithAlignment(align uint64) Option {
+	return func(o *options) {
+		o.alignment = align
+	}
+}
+
+// WithCompactHeaders stores the data length and key of every record as uvarints instead of 8 byte words,
+// shrinking the headers of small records with small keys from 16 to as few as 2 bytes. It can't be combined
+// with WithAlignment. Memory written with compact headers must be reopened with this option unless it has
+// a superblock
+func WithCompactHeaders() Option {
+	return func(o *options) {
+		o.compactHeaders = true
+	}
+}
+
+// WithGrow makes writes that don't fit even after merging the free spaces migrate the records to a larger
+// memory obtained from grow instead of failing with NotEnoughSpace. The records are copied compactly and
+// keep their keys. The memory that is no longer used is passed to release (if not nil), for ex. to unmap it.
+// Slices previously obtained from View or Iterate must not be used once the memory is released
+func WithGrow(grow GrowFunc, release func(mem []byte)) Option {
+	return func(o *options) {
+		o.grow = grow
+		o.release = release
+	}
+}
+
+// WithJournal reserves size bytes after the superblock for a journal logging every move of records made by
+// compaction and merging before it happens, so that OpenGravity can finish a move interrupted by a crash
+// instead of finding the memory half moved. Moves larger than the journal are logged in chunks, a size of 0
+// uses 4096 bytes. Memory written with a journal must be reopened with this option unless it has a superblock
+func WithJournal(size uint64) Option {
+	return func(o *options) {
+		if size == 0 {
+			size = defaultJournalLen
+		}
+		o.journal = size
+	}
+}
+
+// WithIndexShards sets the number of shards of the index from keys to the position of their records, rounded up
+// to a power of two (32 by default). Every shard has its own lock, more shards let more keys be looked up and
+// updated in parallel
+func WithIndexShards(n int) Option {
+	return func(o *options) {
+		if n < 1 {
+			n = 1
+		}
+		o.shards = 1 << bits.Len(uint(n-1))
+	}
+}
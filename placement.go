@@ -0,0 +1,99 @@
+package gravity
+
+import "ohalloc/treap"
+
+// PlacementStrategy decides which free spaces are extracted from the pool to satisfy a write.
+// It's consulted with the free space manager's lock held
+type PlacementStrategy interface {
+	// Select returns the free space to start from to satisfy size bytes. size might be larger than the
+	// largest free space, in which case the selected free space is merged with its neighbours
+	Select(root *treap.Node, size uint64) *treap.Node
+	// Neighbours returns the free spaces (sorted by start) including node that together satisfy size,
+	// the root after removing them and the total size of the returned free spaces
+	Neighbours(root *treap.Node, node *treap.Node, size uint64) (fss []*treap.FreeSpace, nr *treap.Node, ts uint64)
+}
+
+// StatefulPlacement is implemented by placement strategies keeping state between selections. Every Gravity,
+// region and shard selects with its own clone of the strategy
+type StatefulPlacement interface {
+	PlacementStrategy
+	// Clone returns a copy of the strategy in its initial state
+	Clone() PlacementStrategy
+}
+
+// adjacentMerge merges the free spaces following the selected free space followed by the preceding ones
+type adjacentMerge struct{}
+
+func (adjacentMerge) Neighbours(root *treap.Node, node *treap.Node, size uint64) ([]*treap.FreeSpace, *treap.Node, uint64) {
+	return treap.GetFittingNeighbours(root, node, size)
+}
+
+// GravityFit prefers free spaces with higher gravity which tends to form larger free spaces. This is the default
+type GravityFit struct {
+	adjacentMerge
+}
+
+func (GravityFit) Select(root *treap.Node, size uint64) *treap.Node {
+	if root.Size() < size {
+		size = 0
+	}
+	return treap.GreatestGravityNode(root, size)
+}
+
+// FirstFit selects the free space with the lowest start that satisfies the size. The free spaces from the start
+// of the memory are merged if none satisfies the size
+type FirstFit struct {
+	adjacentMerge
+}
+
+func (FirstFit) Select(root *treap.Node, size uint64) *treap.Node {
+	if n := treap.FirstFitNode(root, size); n != nil {
+		return n
+	}
+	return treap.Min(root)
+}
+
+// BestFit selects the smallest free space that satisfies the size. The largest free space is merged with its
+// neighbours if none satisfies the size
+type BestFit struct {
+	adjacentMerge
+}
+
+func (BestFit) Select(root *treap.Node, size uint64) *treap.Node {
+	if n := treap.BestFitNode(root, size); n != nil {
+		return n
+	}
+	return treap.WorstFitNode(root)
+}
+
+// WorstFit selects the largest free space
+type WorstFit struct {
+	adjacentMerge
+}
+
+func (WorstFit) Select(root *treap.Node, size uint64) *treap.Node {
+	return treap.WorstFitNode(root)
+}
+
+// NextFit selects the first free space that satisfies the size starting from where the previous selection ended,
+// wrapping around to the start of the memory. Every region keeps its own cursor
+type NextFit struct {
+	adjacentMerge
+	cursor uint64
+}
+
+func (nf *NextFit) Clone() PlacementStrategy {
+	return &NextFit{}
+}
+
+func (nf *NextFit) Select(root *treap.Node, size uint64) *treap.Node {
+	n := treap.FirstFitNodeFrom(root, nf.cursor, size)
+	if n == nil {
+		n = treap.FirstFitNode(root, size)
+	}
+	if n == nil {
+		n = treap.Min(root)
+	}
+	nf.cursor = n.Fs.Start + size
+	return n
+}
@@ -0,0 +1,139 @@
+package gravity
+
+import (
+	"errors"
+	"ohalloc/treap"
+)
+
+// Additional regions are Gravity instances over their own memory with their own free space manager and vmap
+// holding the positions of their records. The global vmap of the Gravity they were added to holds a region
+// reference for each of their keys. Records never move between regions, so the region reference stays valid
+// while records are moved within the region
+const regionRefFlag = uint64(1) << 62
+
+func isRegionRef(v uint64) bool {
+	return v&(slabLocatorFlag|regionRefFlag) == regionRefFlag
+}
+
+// AddRegion adds mem as an additional region growing the capacity without moving existing records.
+// Writes go to the first region with enough space, in the order the regions were added starting with the
+// memory the Gravity was created with. Keys stay unique across regions.
+// The region uses the options of the Gravity except for the superblock. Additional regions are not persisted,
+// OpenGravity only reopens a single region
+func (g *Gravity) AddRegion(mem []byte) error {
+	g.Lock()
+	defer g.Unlock()
+	if g.root != nil {
+		return errors.New("regions can only be added to the root gravity")
+	}
+
+	o := *g.opts
+	o.superblock = false
+	o.journal = 0
+	r, err := newGravity(mem, &o)
+	if err != nil {
+		return err
+	}
+	r.root = g
+	r.ref = regionRefFlag | uint64(len(g.regions))
+	if err = r.freeAll(); err != nil {
+		return err
+	}
+	g.regions = append(g.regions, r)
+	g.fsm.addRegion(r.fsm)
+	return nil
+}
+
+// Regions returns the number of memory regions including the memory the Gravity was created with
+func (g *Gravity) Regions() int {
+	g.RLock()
+	defer g.RUnlock()
+	return len(g.regions) + 1
+}
+
+// all returns every region starting with the Gravity itself
+func (g *Gravity) all() []*Gravity {
+	return append([]*Gravity{g}, g.regions...)
+}
+
+// freeAll marks the entire data region of the memory as a single free space
+func (g *Gravity) freeAll() error {
+	fs := &treap.FreeSpace{Start: g.base, End: g.size - 1}
+	g.markFree(fs)
+	return g.fsm.add(fs)
+}
+
+// locate returns the region holding the key along with the position (or slab locator) of the key in the region
+func (g *Gravity) locate(key uint64) (*Gravity, uint64, error) {
+	pos, err := g.loadFromVPos(key)
+	if err != nil || !isRegionRef(pos) {
+		return g, pos, err
+	}
+	r := g.regions[pos&^regionRefFlag]
+	pos, err = r.loadFromVPos(key)
+	return r, pos, err
+}
+
+// refer points the key in the global vmap to the region r holding it
+func (g *Gravity) refer(r *Gravity, k uint64) {
+	if r != g {
+		g.vmap.store(k, r.ref)
+	}
+}
+
+// take removes the key from the global vmap and then from the vmap of the region holding it, and returns the
+// region along with the position of the key in it. Only one of the callers taking a key concurrently gets it
+func (g *Gravity) take(k uint64) (*Gravity, uint64, error) {
+	if g.slab.isPage(k) {
+		return nil, 0, WrongReadPosition
+	}
+	pos, ok := g.vmap.loadAndDelete(k)
+	if !ok {
+		return nil, 0, WrongReadPosition
+	}
+	if !isRegionRef(pos) {
+		return g, pos, nil
+	}
+	r := g.regions[pos&^regionRefFlag]
+	if pos, ok = r.vmap.loadAndDelete(k); !ok {
+		return nil, 0, WrongReadPosition
+	}
+	return r, pos, nil
+}
+
+// writeAny writes the data to the first region with enough space, growing the memory if none has
+func (g *Gravity) writeAny(k uint64, data []byte) error {
+	var err error
+	for _, r := range g.all() {
+		if err = r.write(k, data); err != NotEnoughSpace {
+			if err == nil {
+				g.refer(r, k)
+			}
+			return err
+		}
+	}
+	if err = g.grow(g.spaceFor(k, data)); err != nil {
+		return err
+	}
+	return g.write(k, data)
+}
+
+// spaceFor returns the free space required to write the data with the key
+func (g *Gravity) spaceFor(k uint64, data []byte) uint64 {
+	dl := uint64(len(data))
+	if g.slab.classOf(dl) >= 0 {
+		return g.recordLen(g.slab.pageSize, k)
+	}
+	return g.recordLen(dl, k)
+}
+
+// capacity returns the length of the largest region's data region
+func (g *Gravity) capacity() uint64 {
+	c := uint64(0)
+	for _, r := range g.all() {
+		if n := r.size - r.base; n > c {
+			c = n
+		}
+	}
+	return c
+}
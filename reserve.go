@@ -0,0 +1,186 @@
+package gravity
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+var (
+	ReservationDone  = errors.New("reservation already committed or aborted")
+	ReservationsOpen = errors.New("reservations are open")
+)
+
+// Reservation is space reserved in memory for a record whose data is filled in directly by the caller.
+// The reserved span is marked in memory so that it isn't handed out, and records are never moved across it
+// till the reservation is committed or aborted: compaction packs the records on either side of it, and writes
+// that would have to move records across it as well as growing or remapping the memory fail meanwhile.
+// Reads and writes carry on while the data is filled in. A reservation left open when the memory is reopened
+// is free space
+type Reservation struct {
+	g    *Gravity
+	r    *Gravity // region holding the reserved record
+	pos  uint64   // position of the reserved record
+	size uint64   // length of the reserved span
+	key  uint64   // key of the reserved record
+	data []byte
+	done bool
+}
+
+// Reserve reserves space for a record holding n bytes of data
+func (g *Gravity) Reserve(n int) (*Reservation, error) {
+	if n < 0 {
+		return nil, errors.New("negative reservation size")
+	}
+	g.RLock()
+	// the key is issued upfront as the length of compact headers depends on it
+	k := g.getKey()
+	totalLen := g.recordLen(uint64(n), k)
+	g.placing.Lock()
+	g.reclaim()
+	r, pos, err := g.reserveAny(totalLen, false)
+	g.placing.Unlock()
+	g.RUnlock()
+
+	if err == NotEnoughSpace && g.opts.grow != nil {
+		g.Lock()
+		g.reclaim()
+		r, pos, err = g.reserveAny(totalLen, true)
+		g.Unlock()
+	}
+	if err != nil {
+		return nil, g.failed(err)
+	}
+	dataStart := pos + g.headerLen(uint64(n), k)
+	return &Reservation{
+		g:    g,
+		r:    r,
+		pos:  pos,
+		size: totalLen,
+		key:  k,
+		data: r.mem[dataStart : dataStart+uint64(n) : dataStart+uint64(n)],
+	}, nil
+}
+
+// reserveAny reserves size bytes in the first region with enough space and returns the region along with the
+// position of the reserved span. The memory is grown if none has and grow is set, which requires the write lock
+func (g *Gravity) reserveAny(size uint64, grow bool) (*Gravity, uint64, error) {
+	for _, r := range g.all() {
+		pos, err := r.reserve(size)
+		if err != NotEnoughSpace {
+			return r, pos, err
+		}
+	}
+	if !grow {
+		return nil, 0, NotEnoughSpace
+	}
+	if err := g.grow(size); err != nil {
+		return nil, 0, err
+	}
+	pos, err := g.reserve(size)
+	return g, pos, err
+}
+
+// reserve allocates size bytes in the region, marks them reserved and registers the reserved span
+func (g *Gravity) reserve(size uint64) (uint64, error) {
+	fs, err := g.allocate(size)
+	if err != nil {
+		return 0, err
+	}
+	pos := fs.Start
+	fs.Start += size
+	g.markFree(fs)
+	g.markReserved(pos, size)
+	g.resMu.Lock()
+	if g.reserved == nil {
+		g.reserved = make(map[uint64]uint64)
+	}
+	g.reserved[pos] = pos + size - 1
+	g.resMu.Unlock()
+	g.release(fs)
+	return pos, nil
+}
+
+// unreserve removes the reserved span at pos from the registry
+func (g *Gravity) unreserve(pos uint64) {
+	g.resMu.Lock()
+	defer g.resMu.Unlock()
+	delete(g.reserved, pos)
+}
+
+// reserving returns whether the region has open reservations
+func (g *Gravity) reserving() bool {
+	g.resMu.Lock()
+	defer g.resMu.Unlock()
+	return len(g.reserved) > 0
+}
+
+// walled returns whether a reserved span starts at pos
+func (g *Gravity) walled(pos uint64) bool {
+	g.resMu.Lock()
+	defer g.resMu.Unlock()
+	_, ok := g.reserved[pos]
+	return ok
+}
+
+// wallWithin returns the start of the first reserved span starting within [from, to), if any
+func (g *Gravity) wallWithin(from uint64, to uint64) (uint64, bool) {
+	g.resMu.Lock()
+	defer g.resMu.Unlock()
+	wall, walled := uint64(0), false
+	for start := range g.reserved {
+		if start >= from && start < to && (!walled || start < wall) {
+			wall, walled = start, true
+		}
+	}
+	return wall, walled
+}
+
+// Bytes returns the reserved memory into which the data must be written. It must not be used after
+// the reservation is committed or aborted
+func (r *Reservation) Bytes() []byte {
+	return r.data
+}
+
+// Commit publishes the record and returns its key
+func (r *Reservation) Commit() (uint64, error) {
+	if r.done {
+		return 0, ReservationDone
+	}
+	g := r.g
+	g.RLock()
+	defer g.RUnlock()
+	g.placing.RLock()
+	defer g.placing.RUnlock()
+	rg := r.r
+	k := r.key
+	h := rg.putRecordHeader(r.pos, uint64(len(r.data)), k)
+	rg.putChecksum(r.pos, h)
+	rg.vmap.store(k, r.pos)
+	g.refer(rg, k)
+	atomic.AddUint64(&rg.stats.writes, 1)
+	r.finish()
+	// writes waiting for space may now merge the free spaces on either side of the record
+	rg.fsm.unblock()
+	return k, nil
+}
+
+// Abort returns the reserved space to the pool
+func (r *Reservation) Abort() error {
+	if r.done {
+		return ReservationDone
+	}
+	g := r.g
+	g.RLock()
+	defer g.RUnlock()
+	g.placing.RLock()
+	defer g.placing.RUnlock()
+	err := r.r.releaseSpan(r.pos, r.size)
+	r.finish()
+	return err
+}
+
+func (r *Reservation) finish() {
+	r.done = true
+	r.data = nil
+	r.r.unreserve(r.pos)
+}
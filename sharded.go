@@ -0,0 +1,221 @@
+package gravity
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// The keys of a ShardedGravity hold the index of the shard in their top bits and the key issued by the
+// shard in the rest
+const (
+	shardBits  = 8
+	shardShift = 64 - shardBits
+	maxShards  = 1 << shardBits
+	localMask  = uint64(1)<<shardShift - 1
+)
+
+// ShardPolicy selects the shard a write is routed to
+type ShardPolicy interface {
+	// Shard returns the index of the shard to write the data to
+	Shard(shards []*Gravity, data []byte) int
+}
+
+// RoundRobin routes the writes to the shards in turn. This is the default
+type RoundRobin struct {
+	next uint64
+}
+
+func (rr *RoundRobin) Shard(shards []*Gravity, data []byte) int {
+	return int((atomic.AddUint64(&rr.next, 1) - 1) % uint64(len(shards)))
+}
+
+// LeastLoaded routes the writes to the shard with the most free space. The free space is an estimate read
+// without locking the shards, so writes aren't held up by the other shards
+type LeastLoaded struct{}
+
+func (LeastLoaded) Shard(shards []*Gravity, data []byte) int {
+	best, free := 0, uint64(0)
+	for i, g := range shards {
+		if f := g.freeEstimate(); f > free {
+			best, free = i, f
+		}
+	}
+	return best
+}
+
+// ShardedGravity splits the memory into independent Gravity arenas, each with its own locks, free space
+// manager and vmap, so that operations on different shards never contend. The shard of a record is
+// encoded in its key
+type ShardedGravity struct {
+	shards []*Gravity
+	policy ShardPolicy
+}
+
+// SplitMemory splits mem into n parts of equal size to be used as shards
+func SplitMemory(mem []byte, n int) [][]byte {
+	size := len(mem) / n
+	mems := make([][]byte, n)
+	for i := range mems {
+		mems[i] = mem[i*size : (i+1)*size : (i+1)*size]
+	}
+	return mems
+}
+
+// NewShardedGravity creates a Gravity with the options on every memory (see SplitMemory to shard a single
+// memory). Writes are routed by policy, RoundRobin if nil
+func NewShardedGravity(mems [][]byte, policy ShardPolicy, opts ...Option) (*ShardedGravity, error) {
+	return newShardedGravity(mems, policy, NewGravity, opts)
+}
+
+// OpenShardedGravity reopens the shards previously written by a ShardedGravity, in the same order
+func OpenShardedGravity(mems [][]byte, policy ShardPolicy, opts ...Option) (*ShardedGravity, error) {
+	return newShardedGravity(mems, policy, OpenGravity, opts)
+}
+
+func newShardedGravity(mems [][]byte, policy ShardPolicy, open func([]byte, ...Option) (*Gravity, error),
+	opts []Option) (*ShardedGravity, error) {
+	if len(mems) == 0 || len(mems) > maxShards {
+		return nil, errors.New("shards must be between 1 and 256")
+	}
+	if policy == nil {
+		policy = &RoundRobin{}
+	}
+	sg := &ShardedGravity{policy: policy}
+	for _, mem := range mems {
+		g, err := open(mem, opts...)
+		if err != nil {
+			return nil, err
+		}
+		sg.shards = append(sg.shards, g)
+	}
+	return sg, nil
+}
+
+// Shards returns the number of shards
+func (sg *ShardedGravity) Shards() int {
+	return len(sg.shards)
+}
+
+// Write adds the data to the shard selected by the policy and returns its key. The other shards are tried
+// in order if the shard is full
+func (sg *ShardedGravity) Write(data []byte) (uint64, error) {
+	return sg.writeFrom(sg.policy.Shard(sg.shards, data), data)
+}
+
+// WriteHint adds the data to the shard hint modulo the number of shards, for ex. to keep related records
+// together, and returns its key. The other shards are tried in order if the shard is full
+func (sg *ShardedGravity) WriteHint(hint uint64, data []byte) (uint64, error) {
+	return sg.writeFrom(int(hint%uint64(len(sg.shards))), data)
+}
+
+func (sg *ShardedGravity) writeFrom(first int, data []byte) (uint64, error) {
+	var err error
+	for i := range sg.shards {
+		id := (first + i) % len(sg.shards)
+		var k uint64
+		if k, err = sg.shards[id].writeWith(nil, data); err == nil {
+			return uint64(id)<<shardShift | k, nil
+		}
+		if err != NotEnoughSpace {
+			return 0, err
+		}
+	}
+	// the failure is counted once, by the shard the write was meant for
+	return 0, sg.shards[first].failed(err)
+}
+
+// shard returns the shard of the key along with the key issued by the shard
+func (sg *ShardedGravity) shard(key uint64) (*Gravity, uint64, error) {
+	id := key >> shardShift
+	if id >= uint64(len(sg.shards)) {
+		return nil, 0, WrongReadPosition
+	}
+	return sg.shards[id], key & localMask, nil
+}
+
+// Read returns a copy of the value stored for the key
+func (sg *ShardedGravity) Read(key uint64) ([]byte, error) {
+	g, k, err := sg.shard(key)
+	if err != nil {
+		return nil, err
+	}
+	return g.Read(k)
+}
+
+// ReadInto copies the value stored for the key into dst, see Gravity.ReadInto
+func (sg *ShardedGravity) ReadInto(key uint64, dst []byte) (int, error) {
+	g, k, err := sg.shard(key)
+	if err != nil {
+		return 0, err
+	}
+	return g.ReadInto(k, dst)
+}
+
+// View calls fn with the value stored for the key, see Gravity.View
+func (sg *ShardedGravity) View(key uint64, fn func(data []byte) error) error {
+	g, k, err := sg.shard(key)
+	if err != nil {
+		return err
+	}
+	return g.View(k, fn)
+}
+
+// Update replaces the value stored for the key within its shard
+func (sg *ShardedGravity) Update(key uint64, data []byte) error {
+	g, k, err := sg.shard(key)
+	if err != nil {
+		return err
+	}
+	return g.Update(k, data)
+}
+
+// Free frees the memory held by the value of the key
+func (sg *ShardedGravity) Free(key uint64) error {
+	g, k, err := sg.shard(key)
+	if err != nil {
+		return err
+	}
+	return g.Free(k)
+}
+
+// Iterate calls fn for every live record shard by shard, see Gravity.Iterate. pos is the position of the
+// record within its shard
+func (sg *ShardedGravity) Iterate(fn func(pos uint64, key uint64, data []byte) bool) {
+	for id, g := range sg.shards {
+		more := true
+		g.Iterate(func(pos uint64, k uint64, data []byte) bool {
+			more = fn(pos, uint64(id)<<shardShift|k, data)
+			return more
+		})
+		if !more {
+			return
+		}
+	}
+}
+
+// Compact compacts every shard one after the other
+func (sg *ShardedGravity) Compact() {
+	for _, g := range sg.shards {
+		g.Compact()
+	}
+}
+
+// TotalFreeSpace returns the free space across all the shards
+func (sg *ShardedGravity) TotalFreeSpace() uint64 {
+	total := uint64(0)
+	for _, g := range sg.shards {
+		total += g.TotalFreeSpace()
+	}
+	return total
+}
+
+// Stats sums up the stats of all the shards. The shards are reported one after the other, so the stats
+// aren't a consistent view across the shards
+func (sg *ShardedGravity) Stats() Stats {
+	var s Stats
+	for _, g := range sg.shards {
+		s.add(g.Stats())
+	}
+	s.fragmentation()
+	return s
+}
@@ -0,0 +1,533 @@
+package gravity
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"ohalloc/treap"
+	"sync"
+	"sync/atomic"
+)
+
+// Small records can be stored in fixed size slots carved out of slab pages instead of individual records.
+// A slab page is a record in the memory flagged with pageTag whose data is laid out as
+//
+//	[size class (1)][reserved (3)][high 32 bits of the keys (4)][occupancy bitmap (8 byte words)][slots]
+//
+// and every slot holds [data length (1)][low 32 bits of the key (4)][checksum (4, if enabled)][data]. All the
+// slots of a page share the high bits of their keys, so a slot costs 5 bytes of header against the 16 bytes of
+// a record's. As the slots change independently, each slot has its own checksum while the checksum of the page's
+// record only covers its headers and the metadata preceding the bitmap. Pages are moved around by merges like
+// any other record, so vmap stores a slab locator (page id and slot index) for the small records instead of
+// their position
+var slotSizes = []uint64{16, 24, 32, 40, 48, 56, 64, 72, 80, 96, 112, 128}
+
+const (
+	slotKeyLen          = 4
+	slotHeaderLen       = 1 + slotKeyLen
+	pageMetaLen         = uint64(8)
+	defaultSlabPageSize = uint64(4096)
+	slabLocatorFlag     = uint64(1) << 63
+	slotIndexBits       = 16
+	maxSlotsPerPage     = uint64(1) << slotIndexBits
+)
+
+// slabPage is the in-heap state of a slab page
+type slabPage struct {
+	key   uint64 // key of the page's record
+	high  uint64 // high 32 bits of the keys of the slots
+	hl    uint64 // length of the page's record headers
+	class int    // index of the slot size
+	slots uint64 // number of slots in the page
+	used  uint64 // number of occupied slots, guarded by the lock of the class
+}
+
+// slabClass holds the pages of a size class with free slots. The slots of the class are written and freed
+// with mu held, so that writers of different classes don't contend
+type slabClass struct {
+	mu      sync.Mutex
+	partial []uint64 // ids of the pages with free slots
+}
+
+type slab struct {
+	pageSize uint64 // data length of new pages, 0 if small records aren't written to slabs
+	arena    uint64 // length of the region's data region
+	hdr      uint64 // length of the slot headers
+	classes  []slabClass
+	// The pages are registered with mu held. count is the number of pages, so that keys are looked up in
+	// pageKeys only if there's any page
+	mu       sync.RWMutex
+	pages    []*slabPage       // pages indexed by their id, nil for released ids
+	freeIDs  []uint64          // released page ids
+	pageKeys map[uint64]uint64 // page's key to its id
+	count    int64
+}
+
+func newSlab(pageSize uint64, arena uint64, checksum bool) *slab {
+	hdr := uint64(slotHeaderLen)
+	if checksum {
+		hdr += checksumLen
+	}
+	return &slab{
+		pageSize: pageSize,
+		arena:    arena,
+		hdr:      hdr,
+		classes:  make([]slabClass, len(slotSizes)),
+		pageKeys: make(map[uint64]uint64),
+	}
+}
+
+// classOf returns the size class of the slot to hold dl bytes of data, -1 if the data must not go to a slab.
+// Pages that can't fit the region along with their headers are never allocated
+func (s *slab) classOf(dl uint64) int {
+	if s.pageSize == 0 || s.pageSize+headerLen+keyLen > s.arena {
+		return -1
+	}
+	for c, size := range slotSizes {
+		if dl+s.hdr <= size && slotsPerPage(s.pageSize, size) > 0 {
+			return c
+		}
+	}
+	return -1
+}
+
+func (s *slab) isPage(key uint64) bool {
+	_, ok := s.pageOf(key)
+	return ok
+}
+
+// pageOf returns the page whose record has the key
+func (s *slab) pageOf(key uint64) (*slabPage, bool) {
+	if atomic.LoadInt64(&s.count) == 0 {
+		return nil, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	id, ok := s.pageKeys[key]
+	if !ok {
+		return nil, false
+	}
+	return s.pages[id], true
+}
+
+// addPage registers the page and returns its id. The caller must hold the lock of the page's class
+func (s *slab) addPage(p *slabPage) uint64 {
+	s.mu.Lock()
+	var id uint64
+	if n := len(s.freeIDs); n > 0 {
+		id = s.freeIDs[n-1]
+		s.freeIDs = s.freeIDs[:n-1]
+		s.pages[id] = p
+	} else {
+		id = uint64(len(s.pages))
+		s.pages = append(s.pages, p)
+	}
+	s.pageKeys[p.key] = id
+	atomic.AddInt64(&s.count, 1)
+	s.mu.Unlock()
+	if p.used < p.slots {
+		c := &s.classes[p.class]
+		c.partial = append(c.partial, id)
+	}
+	return id
+}
+
+// removePage unregisters the page. The caller must hold the lock of the page's class
+func (s *slab) removePage(id uint64) {
+	s.mu.Lock()
+	p := s.pages[id]
+	delete(s.pageKeys, p.key)
+	s.pages[id] = nil
+	s.freeIDs = append(s.freeIDs, id)
+	atomic.AddInt64(&s.count, -1)
+	s.mu.Unlock()
+	s.classes[p.class].removePartial(id)
+}
+
+// partialPage returns the id of a page of the class with a free slot for the keys sharing the high bits. The
+// caller must hold the lock of the class
+func (s *slab) partialPage(c *slabClass, high uint64) (uint64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i := len(c.partial) - 1; i >= 0; i-- {
+		if s.pages[c.partial[i]].high == high {
+			return c.partial[i], true
+		}
+	}
+	return 0, false
+}
+
+func (c *slabClass) removePartial(id uint64) {
+	ids := c.partial
+	for i := range ids {
+		if ids[i] == id {
+			ids[i] = ids[len(ids)-1]
+			c.partial = ids[:len(ids)-1]
+			return
+		}
+	}
+}
+
+func (s *slab) get(id uint64) *slabPage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.pages[id]
+}
+
+// page returns the page and its id referred by the slab locator
+func (s *slab) page(loc uint64) (*slabPage, uint64, bool) {
+	id, _ := decodeSlabLocator(loc)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if id >= uint64(len(s.pages)) || s.pages[id] == nil {
+		return nil, 0, false
+	}
+	return s.pages[id], id, true
+}
+
+func slabLocator(id uint64, slot uint64) uint64 {
+	return slabLocatorFlag | id<<slotIndexBits | slot
+}
+
+func decodeSlabLocator(loc uint64) (id uint64, slot uint64) {
+	return (loc &^ slabLocatorFlag) >> slotIndexBits, loc & (maxSlotsPerPage - 1)
+}
+
+func isSlabLocator(v uint64) bool {
+	return v&slabLocatorFlag != 0
+}
+
+func bitmapLen(slots uint64) uint64 {
+	return (slots + 63) / 64 * 8
+}
+
+// slotsPerPage returns the number of slots of slotSize that fit in a page along with the page's metadata
+func slotsPerPage(pageSize uint64, slotSize uint64) uint64 {
+	if pageSize <= pageMetaLen {
+		return 0
+	}
+	n := (pageSize - pageMetaLen) / slotSize
+	for n > 0 && pageMetaLen+bitmapLen(n)+n*slotSize > pageSize {
+		n--
+	}
+	if n > maxSlotsPerPage {
+		n = maxSlotsPerPage
+	}
+	return n
+}
+
+// slotPos returns the position of the slot in the page present at pagePos
+func (g *Gravity) slotPos(p *slabPage, pagePos uint64, slot uint64) uint64 {
+	return pagePos + p.hl + pageMetaLen + bitmapLen(p.slots) + slot*slotSizes[p.class]
+}
+
+// slotBit returns the position of the bitmap word holding the slot's occupancy and the slot's bit in it
+func (g *Gravity) slotBit(p *slabPage, pagePos uint64, slot uint64) (uint64, uint64) {
+	return pagePos + p.hl + pageMetaLen + slot/64*8, uint64(1) << (slot % 64)
+}
+
+// slotKey returns the key of the record held by the slot at sp of the page p
+func (g *Gravity) slotKey(p *slabPage, sp uint64) uint64 {
+	return p.high<<32 | uint64(binary.LittleEndian.Uint32(g.mem[sp+1:sp+slotHeaderLen]))
+}
+
+// slotChecksum computes the CRC32C of the length and key of the slot at sp along with its data
+func (g *Gravity) slotChecksum(sp uint64) uint32 {
+	c := crc32.Update(0, castagnoli, g.mem[sp:sp+slotHeaderLen])
+	start := sp + g.slab.hdr
+	return crc32.Update(c, castagnoli, g.mem[start:start+uint64(g.mem[sp])])
+}
+
+// putSlotChecksum stores the checksum of the slot at sp if checksums are enabled
+func (g *Gravity) putSlotChecksum(sp uint64) {
+	if g.opts.checksum {
+		binary.LittleEndian.PutUint32(g.mem[sp+slotHeaderLen:sp+slotHeaderLen+checksumLen], g.slotChecksum(sp))
+	}
+}
+
+// pageChecksum computes the CRC32C of the headers of the page's record (excluding the checksum itself) and
+// the metadata of the page
+func (g *Gravity) pageChecksum(pos uint64, h recordHeader) uint32 {
+	c := crc32.Update(0, castagnoli, g.mem[pos:pos+h.hl-checksumLen])
+	return crc32.Update(c, castagnoli, g.mem[pos+h.hl:pos+h.hl+pageMetaLen])
+}
+
+// putPageChecksum stores the checksum of the page at pos if checksums are enabled
+func (g *Gravity) putPageChecksum(pos uint64, h recordHeader) {
+	if !g.opts.checksum {
+		return
+	}
+	cpos := pos + h.hl - checksumLen
+	binary.LittleEndian.PutUint32(g.mem[cpos:cpos+checksumLen], g.pageChecksum(pos, h))
+}
+
+func (g *Gravity) isSlotUsed(p *slabPage, pagePos uint64, slot uint64) bool {
+	wpos, bit := g.slotBit(p, pagePos, slot)
+	return binary.LittleEndian.Uint64(g.mem[wpos:wpos+8])&bit != 0
+}
+
+func (g *Gravity) setSlot(p *slabPage, pagePos uint64, slot uint64, used bool) {
+	wpos, bit := g.slotBit(p, pagePos, slot)
+	w := binary.LittleEndian.Uint64(g.mem[wpos : wpos+8])
+	if used {
+		w |= bit
+	} else {
+		w &^= bit
+	}
+	binary.LittleEndian.PutUint64(g.mem[wpos:wpos+8], w)
+}
+
+// slabWrite writes the data to a free slot of its size class, allocating a new page if required. The caller
+// must hold placing, shared if fit is set in which case the page is only allocated from a free space large
+// enough for it and needsMerge is returned if there's none. Otherwise the data is written as a record if there
+// isn't enough space left for a new page
+func (g *Gravity) slabWrite(k uint64, data []byte, class int, fit bool) error {
+	s := g.slab
+	c := &s.classes[class]
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id, ok := s.partialPage(c, k>>32)
+	if !ok {
+		var err error
+		if id, err = g.newPage(class, k>>32, fit); err == NotEnoughSpace {
+			return g.writeRecord(k, data)
+		} else if err != nil {
+			return err
+		}
+	}
+	p := s.get(id)
+	pagePos, _ := g.vmap.load(p.key)
+
+	// readers of the page's slots hold the page's shard
+	sh := g.vmap.locked(p.key)
+	slot := uint64(0)
+	for g.isSlotUsed(p, pagePos, slot) {
+		slot++
+	}
+	// the slot is filled before being marked as used
+	sp := g.slotPos(p, pagePos, slot)
+	g.mem[sp] = byte(len(data))
+	binary.LittleEndian.PutUint32(g.mem[sp+1:sp+slotHeaderLen], uint32(k))
+	copy(g.mem[sp+s.hdr:], data)
+	g.putSlotChecksum(sp)
+	g.setSlot(p, pagePos, slot, true)
+	sh.Unlock()
+
+	p.used++
+	if p.used == p.slots {
+		c.removePartial(id)
+	}
+	g.vmap.store(k, slabLocator(id, slot))
+	atomic.AddUint64(&g.stats.writes, 1)
+	return nil
+}
+
+// newPage allocates a slab page for the size class and the keys sharing the high bits and returns its id. The
+// caller must hold the lock of the class. If fit is set, the page is only allocated from a free space large
+// enough for it and needsMerge is returned if there's none
+func (g *Gravity) newPage(class int, high uint64, fit bool) (uint64, error) {
+	dl := g.slab.pageSize
+	k := g.getKey()
+	totalLen := g.recordLen(dl, k)
+	var fs *treap.FreeSpace
+	var err error
+	if fit {
+		fs, err = g.fsm.extractFit(totalLen)
+	} else {
+		fs, err = g.allocate(totalLen)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer g.release(fs)
+
+	pos := fs.Start
+	fs.Start += totalLen
+	g.markFree(fs)
+
+	p := &slabPage{key: k, high: high, hl: g.headerLen(dl, k), class: class, slots: slotsPerPage(dl, slotSizes[class])}
+	meta := pos + p.hl
+	for i := meta; i < meta+pageMetaLen+bitmapLen(p.slots); i++ {
+		g.mem[i] = 0
+	}
+	g.mem[meta] = byte(class)
+	binary.LittleEndian.PutUint32(g.mem[meta+4:meta+pageMetaLen], uint32(high))
+	g.putPageChecksum(pos, g.putPageHeader(pos, dl, p.key))
+	// the page is registered first so that its key is never read as a record
+	id := g.slab.addPage(p)
+	g.vmap.store(p.key, pos)
+	return id, nil
+}
+
+// slotAt returns the page holding the slot referred by the slab locator along with the positions of the page
+// and the slot
+func (g *Gravity) slotAt(loc uint64) (p *slabPage, pagePos uint64, sp uint64, ok bool) {
+	if p, _, ok = g.slab.page(loc); !ok {
+		return nil, 0, 0, false
+	}
+	_, slot := decodeSlabLocator(loc)
+	if pagePos, ok = g.vmap.load(p.key); !ok || isSlabLocator(pagePos) {
+		return nil, 0, 0, false
+	}
+	return p, pagePos, g.slotPos(p, pagePos, slot), true
+}
+
+// slabData returns the data of the key stored in the slot referred by the slab locator
+func (g *Gravity) slabData(key uint64, loc uint64) ([]byte, error) {
+	p, pagePos, _, ok := g.slotAt(loc)
+	if !ok {
+		return nil, WrongReadPosition
+	}
+	return g.slotData(key, loc, p, pagePos)
+}
+
+// slotData returns the data of the key stored in the slot referred by the slab locator of the page p at pagePos
+func (g *Gravity) slotData(key uint64, loc uint64, p *slabPage, pagePos uint64) ([]byte, error) {
+	_, slot := decodeSlabLocator(loc)
+	sp := g.slotPos(p, pagePos, slot)
+	if g.slotKey(p, sp) != key || !g.isSlotUsed(p, pagePos, slot) {
+		return nil, &CorruptionError{Key: key, Pos: sp, Err: KeyMismatch}
+	}
+	start := sp + g.slab.hdr
+	end := start + uint64(g.mem[sp])
+	if end > sp+slotSizes[p.class] {
+		return nil, &CorruptionError{Key: key, Pos: sp, Err: WrongReadPosition}
+	}
+	if g.opts.checksum &&
+		binary.LittleEndian.Uint32(g.mem[sp+slotHeaderLen:sp+slotHeaderLen+checksumLen]) != g.slotChecksum(sp) {
+		return nil, &CorruptionError{Key: key, Pos: sp, Err: ChecksumMismatch}
+	}
+	return g.mem[start:end:end], nil
+}
+
+// verifyPage checks that the slab page at pos belongs to the key and matches its checksum (if enabled)
+func (g *Gravity) verifyPage(pos uint64, key uint64) error {
+	h, ok := g.recordAt(pos)
+	if !ok || h.key != key {
+		return &CorruptionError{Key: key, Pos: pos, Err: KeyMismatch}
+	}
+	if g.opts.checksum {
+		cpos := pos + h.hl - checksumLen
+		if binary.LittleEndian.Uint32(g.mem[cpos:cpos+checksumLen]) != g.pageChecksum(pos, h) {
+			return &CorruptionError{Key: key, Pos: pos, Err: ChecksumMismatch}
+		}
+	}
+	return nil
+}
+
+// slabUpdate overwrites the slot referred by the slab locator if the data fits in it or else writes
+// the data afresh and frees the slot
+func (g *Gravity) slabUpdate(key uint64, loc uint64, data []byte) error {
+	p, _, sp, ok := g.slotAt(loc)
+	if !ok {
+		return WrongReadPosition
+	}
+	if uint64(len(data))+g.slab.hdr > slotSizes[p.class] {
+		if err := g.write(key, data); err != nil {
+			return err
+		}
+		return g.slabFree(loc)
+	}
+	sh := g.vmap.locked(p.key)
+	copy(g.mem[sp+g.slab.hdr:], data)
+	g.mem[sp] = byte(len(data))
+	g.putSlotChecksum(sp)
+	sh.Unlock()
+	return nil
+}
+
+// slabFree releases the slot referred by the slab locator and the page once all its slots are free
+func (g *Gravity) slabFree(loc uint64) error {
+	s := g.slab
+	p, id, ok := s.page(loc)
+	if !ok {
+		return WrongReadPosition
+	}
+	c := &s.classes[p.class]
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, slot := decodeSlabLocator(loc)
+	pagePos, _ := g.vmap.load(p.key)
+	sh := g.vmap.locked(p.key)
+	g.setSlot(p, pagePos, slot, false)
+	sh.Unlock()
+	if p.used == p.slots {
+		c.partial = append(c.partial, id)
+	}
+	p.used--
+	atomic.AddUint64(&g.stats.frees, 1)
+	if p.used > 0 {
+		return nil
+	}
+	// the key is dropped first so that it's never read as a record
+	g.vmap.loadAndDelete(p.key)
+	s.removePage(id)
+	h, _ := g.recordAt(pagePos)
+	return g.releaseSpan(pagePos, g.recordLen(h.dl, h.key))
+}
+
+// loadPage registers the slab page present at pos with its slots while reopening the memory and returns
+// the largest key found
+func (g *Gravity) loadPage(s span) (uint64, error) {
+	pos := s.pos
+	class := int(g.mem[pos+s.hl])
+	if class >= len(slotSizes) {
+		return 0, CorruptedMemory
+	}
+	high := uint64(binary.LittleEndian.Uint32(g.mem[pos+s.hl+4 : pos+s.hl+pageMetaLen]))
+	p := &slabPage{key: s.key, high: high, hl: s.hl, class: class, slots: slotsPerPage(s.dl, slotSizes[class])}
+	maxKey := s.key
+	var slots []uint64
+	keys := make(map[uint64]struct{})
+	for slot := uint64(0); slot < p.slots; slot++ {
+		if !g.isSlotUsed(p, pos, slot) {
+			continue
+		}
+		sp := g.slotPos(p, pos, slot)
+		k := g.slotKey(p, sp)
+		// the page itself is only registered once all its slots are checked
+		if k == 0 || k == s.key || g.slab.isPage(k) || uint64(g.mem[sp])+g.slab.hdr > slotSizes[class] {
+			return 0, CorruptedMemory
+		}
+		if _, ok := keys[k]; ok {
+			return 0, CorruptedMemory
+		}
+		keys[k] = struct{}{}
+		if _, ok := g.vmap.load(k); ok {
+			// the record written by an update interrupted before freeing the slot is found first and kept
+			g.setSlot(p, pos, slot, false)
+			continue
+		}
+		slots = append(slots, slot)
+		if k > maxKey {
+			maxKey = k
+		}
+		p.used++
+	}
+	g.vmap.store(s.key, pos)
+	id := g.slab.addPage(p)
+	for _, slot := range slots {
+		sp := g.slotPos(p, pos, slot)
+		g.vmap.store(g.slotKey(p, sp), slabLocator(id, slot))
+	}
+	return maxKey, nil
+}
+
+// iteratePage calls fn for every occupied slot in the page present at pos
+func (g *Gravity) iteratePage(pos uint64, key uint64, fn func(pos uint64, key uint64, data []byte) bool) bool {
+	p, ok := g.slab.pageOf(key)
+	if !ok {
+		return true
+	}
+	for slot := uint64(0); slot < p.slots; slot++ {
+		if !g.isSlotUsed(p, pos, slot) {
+			continue
+		}
+		sp := g.slotPos(p, pos, slot)
+		start := sp + g.slab.hdr
+		end := start + uint64(g.mem[sp])
+		if !fn(sp, g.slotKey(p, sp), g.mem[start:end:end]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,173 @@
+package gravity
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sync/atomic"
+)
+
+// Snapshot stream layout (little endian)
+//
+//	[0:8]   magic
+//	[8:12]  format version
+//	[12:16] flags (reserved)
+//	[16:24] last issued key
+//	records, each as uvarint key, uvarint data length and the data
+//	uvarint 0 marking the end of the records
+//	[0:8]   number of records
+//	[8:12]  CRC32C of everything preceding it
+const (
+	snapshotHeaderLen  = 24
+	snapshotTrailerLen = 12
+	snapMagic          = uint64(0x0050414e53565247) // "GRVSNAP\0"
+	snapVersion        = uint32(1)
+)
+
+var InvalidSnapshot = errors.New("invalid snapshot")
+
+// Snapshot writes the live records of every region along with the key counter to w as a versioned stream
+// that can be restored with Restore. The snapshot is consistent as the read lock is held while writing it,
+// records are streamed straight from the memory without being buffered
+func (g *Gravity) Snapshot(w io.Writer) error {
+	g.RLock()
+	defer g.RUnlock()
+	g.placing.Lock()
+	defer g.placing.Unlock()
+
+	bw := bufio.NewWriter(w)
+	crc := crc32.New(castagnoli)
+	sw := io.MultiWriter(bw, crc)
+
+	var buf [snapshotHeaderLen]byte
+	binary.LittleEndian.PutUint64(buf[:], snapMagic)
+	binary.LittleEndian.PutUint32(buf[8:], snapVersion)
+	binary.LittleEndian.PutUint64(buf[16:], atomic.LoadUint64(&g.key))
+	if _, err := sw.Write(buf[:]); err != nil {
+		return err
+	}
+
+	var err error
+	count := uint64(0)
+	rh := make([]byte, 2*binary.MaxVarintLen64)
+	for _, r := range g.all() {
+		if !r.iterate(func(_ uint64, key uint64, data []byte) bool {
+			n := binary.PutUvarint(rh, key)
+			n += binary.PutUvarint(rh[n:], uint64(len(data)))
+			if _, err = sw.Write(rh[:n]); err != nil {
+				return false
+			}
+			_, err = sw.Write(data)
+			count++
+			return err == nil
+		}) {
+			return err
+		}
+	}
+
+	n := binary.PutUvarint(rh, 0)
+	if _, err = sw.Write(rh[:n]); err != nil {
+		return err
+	}
+	var trailer [snapshotTrailerLen]byte
+	binary.LittleEndian.PutUint64(trailer[:], count)
+	binary.LittleEndian.PutUint32(trailer[8:], crc.Sum32())
+	if _, err = bw.Write(trailer[:]); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Restore creates a Gravity on mem with the options and writes the records of the snapshot read from r
+// compactly at the start of the memory, keeping their keys and the key counter. The records are read one at
+// a time, InvalidSnapshot is returned if the stream is corrupted in which case the memory must be discarded
+func Restore(r io.Reader, mem []byte, opts ...Option) (*Gravity, error) {
+	sr := &snapshotReader{r: bufio.NewReader(r), crc: crc32.New(castagnoli)}
+	var buf [snapshotHeaderLen]byte
+	if _, err := io.ReadFull(sr, buf[:]); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint64(buf[:]) != snapMagic {
+		return nil, InvalidSnapshot
+	}
+	if binary.LittleEndian.Uint32(buf[8:]) != snapVersion {
+		return nil, IncompatibleFormat
+	}
+	key := binary.LittleEndian.Uint64(buf[16:])
+
+	g, err := NewGravity(mem, opts...)
+	if err != nil {
+		return nil, err
+	}
+	// keys issued while restoring (for ex. for slab pages) follow the keys of the snapshot
+	g.key = key
+	var data []byte
+	count := uint64(0)
+	for {
+		k, err := binary.ReadUvarint(sr)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if k == 0 {
+			break
+		}
+		dl, err := binary.ReadUvarint(sr)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := g.vmap.load(k); ok || k > key {
+			return nil, InvalidSnapshot
+		}
+		if dl > uint64(len(mem)) && g.opts.grow == nil {
+			return nil, NotEnoughSpace
+		}
+		if uint64(cap(data)) < dl {
+			data = make([]byte, dl)
+		}
+		data = data[:dl]
+		if _, err = io.ReadFull(sr, data); err != nil {
+			return nil, err
+		}
+		if err = g.writeAny(k, data); err != nil {
+			return nil, err
+		}
+		count++
+	}
+
+	sum := sr.crc.Sum32()
+	var trailer [snapshotTrailerLen]byte
+	if _, err = io.ReadFull(sr.r, trailer[:]); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint64(trailer[:]) != count || binary.LittleEndian.Uint32(trailer[8:]) != sum {
+		return nil, InvalidSnapshot
+	}
+	g.persistKey(g.key)
+	return g, nil
+}
+
+// snapshotReader reads the snapshot stream and computes its checksum
+type snapshotReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+}
+
+func (s *snapshotReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.crc.Write(p[:n])
+	return n, err
+}
+
+func (s *snapshotReader) ReadByte() (byte, error) {
+	b, err := s.r.ReadByte()
+	if err == nil {
+		s.crc.Write([]byte{b})
+	}
+	return b, err
+}
@@ -0,0 +1,144 @@
+package gravity
+
+import "sync/atomic"
+
+// counters are cumulative counts of the operations performed on Gravity
+type counters struct {
+	writes         uint64
+	frees          uint64
+	merges         uint64
+	bytesMoved     uint64
+	notEnoughSpace uint64
+	grows          uint64
+}
+
+// Stats is a report of the memory usage and the operations performed on Gravity
+type Stats struct {
+	Size        uint64 // Size of memory available to records in all the regions (excludes the superblock)
+	Records     uint64 // Number of live records
+	LiveBytes   uint64 // Total data length of the live records
+	HeaderBytes uint64 // Total length of the headers of the live records and the slab pages' metadata
+	// PaddingBytes is the total length of the padding following the records to keep their data aligned
+	PaddingBytes uint64
+	// SlabPages is the number of slab pages and SlabUnusedBytes the bytes of the pages not holding live records
+	// or headers. Size = LiveBytes + HeaderBytes + PaddingBytes + SlabUnusedBytes + TotalFreeSpace
+	SlabPages       uint64
+	SlabUnusedBytes uint64
+
+	FreeSpaces       uint64 // Number of free spaces
+	TotalFreeSpace   uint64 // Sum of the sizes of all the free spaces including BufferedBytes
+	BufferedBytes    uint64 // Free space claimed by allocation buffers
+	LargestFreeSpace uint64 // Size of the largest free space
+	// FreeSpaceHistogram[i] is the number of free spaces whose size is in the range [2^i, 2^(i+1))
+	FreeSpaceHistogram [64]uint64
+	// Fragmentation is the fraction of the free space outside the largest free space. A write larger than
+	// the largest free space requires data to be moved
+	Fragmentation float64
+
+	Writes               uint64 // Records written (including records relocated by Update)
+	Frees                uint64 // Records freed (including records relocated by Update)
+	Merges               uint64 // Writes that moved data to merge free spaces
+	BytesMoved           uint64 // Bytes moved while merging free spaces
+	NotEnoughSpaceErrors uint64 // Writes, updates and reservations that failed with NotEnoughSpace
+	Grows                uint64 // Times the records were migrated to a larger memory
+}
+
+// Stats reports the current memory usage along with the cumulative operation counters, summed up across
+// all the regions
+func (g *Gravity) Stats() Stats {
+	g.RLock()
+	defer g.RUnlock()
+	g.placing.Lock()
+	defer g.placing.Unlock()
+
+	var s Stats
+	for _, r := range g.all() {
+		rs := r.regionStats()
+		// the chunks of the allocation buffers are free space, and the records written to them are counted
+		// before the buffers are flushed
+		buffered, writes := g.buffered(r)
+		rs.BufferedBytes = buffered
+		rs.TotalFreeSpace += buffered
+		rs.Writes += writes
+		s.add(rs)
+	}
+	s.fragmentation()
+	return s
+}
+
+// fragmentation computes Fragmentation from the summed up free spaces
+func (s *Stats) fragmentation() {
+	if s.TotalFreeSpace > 0 {
+		s.Fragmentation = 1 - float64(s.LargestFreeSpace)/float64(s.TotalFreeSpace)
+	}
+}
+
+// add sums up the stats of a region except for Fragmentation
+func (s *Stats) add(o Stats) {
+	s.Size += o.Size
+	s.Records += o.Records
+	s.LiveBytes += o.LiveBytes
+	s.HeaderBytes += o.HeaderBytes
+	s.PaddingBytes += o.PaddingBytes
+	s.SlabPages += o.SlabPages
+	s.SlabUnusedBytes += o.SlabUnusedBytes
+	s.FreeSpaces += o.FreeSpaces
+	s.TotalFreeSpace += o.TotalFreeSpace
+	s.BufferedBytes += o.BufferedBytes
+	if o.LargestFreeSpace > s.LargestFreeSpace {
+		s.LargestFreeSpace = o.LargestFreeSpace
+	}
+	for i, n := range o.FreeSpaceHistogram {
+		s.FreeSpaceHistogram[i] += n
+	}
+	s.Writes += o.Writes
+	s.Frees += o.Frees
+	s.Merges += o.Merges
+	s.BytesMoved += o.BytesMoved
+	s.NotEnoughSpaceErrors += o.NotEnoughSpaceErrors
+	s.Grows += o.Grows
+}
+
+// regionStats reports the memory usage and the operation counters of the region
+func (g *Gravity) regionStats() Stats {
+	s := Stats{
+		Size:                 g.size - g.base,
+		Writes:               atomic.LoadUint64(&g.stats.writes),
+		Frees:                atomic.LoadUint64(&g.stats.frees),
+		Merges:               atomic.LoadUint64(&g.stats.merges),
+		BytesMoved:           atomic.LoadUint64(&g.stats.bytesMoved),
+		NotEnoughSpaceErrors: atomic.LoadUint64(&g.stats.notEnoughSpace),
+		Grows:                atomic.LoadUint64(&g.stats.grows),
+	}
+	g.vmap.iterate(func(key uint64, pos uint64) bool {
+		if isRegionRef(pos) {
+			return true
+		}
+		if isSlabLocator(pos) {
+			p, _, sp, _ := g.slotAt(pos)
+			dl := uint64(g.mem[sp])
+			s.Records++
+			s.LiveBytes += dl
+			s.HeaderBytes += g.slab.hdr
+			s.SlabUnusedBytes += slotSizes[p.class] - g.slab.hdr - dl
+			return true
+		}
+		h, _ := g.recordAt(pos)
+		s.PaddingBytes += g.recordLen(h.dl, h.key) - h.hl - h.dl
+		if p, ok := g.slab.pageOf(key); ok {
+			meta := pageMetaLen + bitmapLen(p.slots)
+			s.SlabPages++
+			s.HeaderBytes += h.hl + meta
+			s.SlabUnusedBytes += h.dl - meta - p.used*slotSizes[p.class]
+			return true
+		}
+		s.Records++
+		s.LiveBytes += h.dl
+		s.HeaderBytes += h.hl
+		return true
+	})
+
+	s.FreeSpaces, s.LargestFreeSpace, s.FreeSpaceHistogram = g.fsm.freeSpaceStats()
+	s.TotalFreeSpace = g.fsm.totalFreeSpaceSize()
+	return s
+}
@@ -0,0 +1,150 @@
+package gravity
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+)
+
+// Superblock layout (little endian) reserved at the start of the memory
+//
+//	[0:8]   magic
+//	[8:12]  format version
+//	[12:16] layout flags
+//	[16:18] header length
+//	[18:20] key length
+//	[20:22] record alignment (0 if unaligned)
+//	[24:32] key lease (no key above it has been issued)
+//	[32:40] journal length (0 if disabled)
+//	[40:64] reserved
+const (
+	superblockLen   = uint64(64)
+	sbMagic         = uint64(0x0059544956415247) // "GRAVITY\0"
+	sbVersion       = uint32(1)
+	sbVersionOffset = 8
+	sbFlagsOffset   = 12
+	sbHeaderOffset  = 16
+	sbKeyLenOffset  = 18
+	sbAlignOffset   = 20
+	sbKeyOffset     = 24
+	sbJournalOffset = 32
+
+	keyLease = uint64(1024) // number of keys issued between two writes of the key stored in the superblock
+)
+
+// layout flags stored in the superblock
+const (
+	sbFlagChecksum = uint32(1 << iota)
+	sbFlagCompactHeaders
+	sbFlagJournal
+	sbFlagAligned
+	sbFlagSlab
+	sbKnownFlags = sbFlagChecksum | sbFlagCompactHeaders | sbFlagJournal | sbFlagAligned | sbFlagSlab
+)
+
+var (
+	NoSuperblock       = errors.New("superblock not found")
+	IncompatibleFormat = errors.New("incompatible format")
+)
+
+// Superblock describes an arena created with WithSuperblock
+type Superblock struct {
+	Version   uint32 // format version
+	Flags     uint32 // layout flags
+	HeaderLen uint16 // length of the record's size header
+	KeyLen    uint16 // length of the record's key
+	Alignment uint16 // alignment of the record's data, 0 if unaligned
+	Key       uint64 // key lease, no key above it has been issued
+	Journal   uint64 // length of the journal, 0 if disabled
+}
+
+// ReadSuperblock decodes the superblock at the start of mem and validates that this version of
+// Gravity can work with the arena
+func ReadSuperblock(mem []byte) (*Superblock, error) {
+	if uint64(len(mem)) < superblockLen || binary.LittleEndian.Uint64(mem) != sbMagic {
+		return nil, NoSuperblock
+	}
+	sb := &Superblock{
+		Version:   binary.LittleEndian.Uint32(mem[sbVersionOffset:]),
+		Flags:     binary.LittleEndian.Uint32(mem[sbFlagsOffset:]),
+		HeaderLen: binary.LittleEndian.Uint16(mem[sbHeaderOffset:]),
+		KeyLen:    binary.LittleEndian.Uint16(mem[sbKeyLenOffset:]),
+		Alignment: binary.LittleEndian.Uint16(mem[sbAlignOffset:]),
+		Key:       binary.LittleEndian.Uint64(mem[sbKeyOffset:]),
+		Journal:   binary.LittleEndian.Uint64(mem[sbJournalOffset:]),
+	}
+	if sb.Version != sbVersion || sb.Flags&^sbKnownFlags != 0 ||
+		uint64(sb.HeaderLen) != headerLen || uint64(sb.KeyLen) != keyLen {
+		return sb, IncompatibleFormat
+	}
+	return sb, nil
+}
+
+// apply sets the options describing the layout of the arena. Slab pages are only written to an arena created
+// with WithSlab, the size of new pages is still taken from the options
+func (sb *Superblock) apply(o *options) {
+	o.superblock = true
+	o.checksum = sb.Flags&sbFlagChecksum != 0
+	o.compactHeaders = sb.Flags&sbFlagCompactHeaders != 0
+	o.alignment = 0
+	if sb.Flags&sbFlagAligned != 0 {
+		o.alignment = uint64(sb.Alignment)
+	}
+	o.journal = 0
+	if sb.Flags&sbFlagJournal != 0 {
+		o.journal = sb.Journal
+	}
+	if sb.Flags&sbFlagSlab == 0 {
+		o.slabPageSize = 0
+	}
+}
+
+// flags returns the superblock layout flags for the options
+func (o *options) flags() uint32 {
+	f := uint32(0)
+	if o.checksum {
+		f |= sbFlagChecksum
+	}
+	if o.compactHeaders {
+		f |= sbFlagCompactHeaders
+	}
+	if o.journal != 0 {
+		f |= sbFlagJournal
+	}
+	if o.alignment != 0 {
+		f |= sbFlagAligned
+	}
+	if o.slabPageSize != 0 {
+		f |= sbFlagSlab
+	}
+	return f
+}
+
+// writeSuperblock formats the superblock at the start of the memory
+func (g *Gravity) writeSuperblock() {
+	binary.LittleEndian.PutUint64(g.mem, sbMagic)
+	binary.LittleEndian.PutUint32(g.mem[sbVersionOffset:], sbVersion)
+	binary.LittleEndian.PutUint32(g.mem[sbFlagsOffset:], g.opts.flags())
+	binary.LittleEndian.PutUint16(g.mem[sbHeaderOffset:], uint16(headerLen))
+	binary.LittleEndian.PutUint16(g.mem[sbKeyLenOffset:], uint16(keyLen))
+	binary.LittleEndian.PutUint16(g.mem[sbAlignOffset:], uint16(g.opts.alignment))
+	binary.LittleEndian.PutUint64(g.mem[sbJournalOffset:], g.opts.journal)
+	binary.LittleEndian.PutUint64(g.mem[sbKeyOffset:], g.key)
+}
+
+// persistKey makes sure that the key stored in the superblock is at least k. Keys are leased in blocks of
+// keyLease: the end of the block holding k is stored, so that the superblock is only written when a key crosses
+// into the next block. The keys up to the stored key are never issued again once the memory is reopened
+func (g *Gravity) persistKey(k uint64) {
+	if !g.opts.superblock || k <= atomic.LoadUint64(&g.lease) {
+		return
+	}
+	g.keyMu.Lock()
+	defer g.keyMu.Unlock()
+	if k <= atomic.LoadUint64(&g.lease) {
+		return
+	}
+	lease := (k/keyLease + 1) * keyLease
+	binary.LittleEndian.PutUint64(g.mem[sbKeyOffset:], lease)
+	atomic.StoreUint64(&g.lease, lease)
+}
@@ -250,6 +250,39 @@ func Print(root *Node) {
 	log.Printf("# Total Free Spaces Count = %v\n\n", fsCount)
 }
 
+// Floor returns the node with the greatest start less than or equal to pos
+func Floor(root *Node, pos uint64) *Node {
+	var floor *Node
+	crawl := root
+	for crawl != nil {
+		if crawl.Fs.Start > pos {
+			crawl = crawl.left
+		} else {
+			floor = crawl
+			crawl = crawl.right
+		}
+	}
+	return floor
+}
+
+// Min returns the node with the lowest start
+func Min(root *Node) *Node {
+	n, _ := minValueNode(root)
+	return n
+}
+
+// Walk calls fn for every free space in the root's subtree in increasing order of start.
+// The walk stops when fn returns false
+func Walk(root *Node, fn func(fs *FreeSpace) bool) {
+	crawl, _ := minValueNode(root)
+	for crawl != nil {
+		if !fn(crawl.Fs) {
+			return
+		}
+		crawl = crawl.next
+	}
+}
+
 // rotateLeft makes the right node the parent of current node(y)
 func rotateLeft(y *Node) *Node {
 	x := y.right
@@ -1,6 +1,7 @@
 package treap
 
 import (
+	"github.com/stretchr/testify/require"
 	"testing"
 )
 
@@ -30,6 +31,17 @@ func TestInsert(t *testing.T) {
 	}))
 }
 
+func TestFloor(t *testing.T) {
+	var r *Node
+	for _, s := range []uint64{40, 10, 80, 25, 60} {
+		r = Insert(r, NewNode(&FreeSpace{Start: s, End: s + 5}))
+	}
+	require.Nil(t, Floor(r, 9))
+	require.Equal(t, uint64(10), Floor(r, 10).Fs.Start)
+	require.Equal(t, uint64(25), Floor(r, 39).Fs.Start)
+	require.Equal(t, uint64(80), Floor(r, 1000).Fs.Start)
+}
+
 func Benchmark_Insert(b *testing.B) {
 
 	b.Run("Ordered", func(b *testing.B) {
@@ -64,3 +76,19 @@ func height(root *Node) int {
 	}
 	return 1 + left
 }
+
+func TestFitNodes(t *testing.T) {
+	var r *Node
+	// start: size
+	for _, fs := range [][]uint64{{0, 10}, {20, 4}, {30, 50}, {100, 6}, {120, 20}} {
+		r = Insert(r, NewNode(&FreeSpace{Start: fs[0], End: fs[0] + fs[1] - 1}))
+	}
+	require.Equal(t, uint64(0), FirstFitNode(r, 5).Fs.Start)
+	require.Equal(t, uint64(30), FirstFitNode(r, 11).Fs.Start)
+	require.Equal(t, uint64(100), FirstFitNodeFrom(r, 31, 5).Fs.Start)
+	require.Nil(t, FirstFitNodeFrom(r, 121, 5))
+	require.Equal(t, uint64(100), BestFitNode(r, 5).Fs.Start)
+	require.Equal(t, uint64(20), BestFitNode(r, 4).Fs.Start)
+	require.Nil(t, BestFitNode(r, 51))
+	require.Equal(t, uint64(30), WorstFitNode(r).Fs.Start)
+}
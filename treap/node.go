@@ -34,6 +34,16 @@ func (n *Node) Size() uint64 {
 	return n.Fs.Size()
 }
 
+// Next returns the node with the next greater start
+func (n *Node) Next() *Node {
+	return n.next
+}
+
+// Prev returns the node with the next lower start
+func (n *Node) Prev() *Node {
+	return n.prev
+}
+
 // greater compares the start of two nodes
 func (n *Node) greater(other *Node) bool {
 	if n.Fs.Start == other.Fs.Start {
@@ -0,0 +1,41 @@
+package treap
+
+// FirstFitNode returns the node with the lowest start that satisfies the given size, nil if there's none
+func FirstFitNode(root *Node, size uint64) *Node {
+	return FirstFitNodeFrom(root, 0, size)
+}
+
+// FirstFitNodeFrom returns the node with the lowest start at or after pos that satisfies the given size,
+// nil if there's none
+func FirstFitNodeFrom(root *Node, pos uint64, size uint64) *Node {
+	// nodes in the subtree are never larger than the root
+	if root == nil || root.Size() < size {
+		return nil
+	}
+	if root.Fs.Start < pos {
+		return FirstFitNodeFrom(root.right, pos, size)
+	}
+	if n := FirstFitNodeFrom(root.left, pos, size); n != nil {
+		return n
+	}
+	return root
+}
+
+// BestFitNode returns the smallest node that satisfies the given size, nil if there's none
+func BestFitNode(root *Node, size uint64) *Node {
+	if root == nil || root.Size() < size {
+		return nil
+	}
+	best := root
+	for _, n := range []*Node{BestFitNode(root.left, size), BestFitNode(root.right, size)} {
+		if n != nil && n.Size() < best.Size() {
+			best = n
+		}
+	}
+	return best
+}
+
+// WorstFitNode returns the largest node
+func WorstFitNode(root *Node) *Node {
+	return root
+}
@@ -1,56 +1,96 @@
 package gravity
 
-// maxBucket to shard the keys. should be a power of 2
+import "sync"
+
+// maxBucket is the default number of shards of the keys. should be a power of 2
 const maxBucket = 0x20
 
+// shard holds the keys of a bucket guarded by its own lock, so that keys of different shards are accessed
+// in parallel
 type shard struct {
+	sync.RWMutex
 	m map[uint64]uint64
 }
 
+// vmap is safe for concurrent use. Every operation locks only the shard of the key
 type vmap struct {
-	bucket map[int]*shard
+	bucket []*shard
+	mask   uint64
 }
 
-func newShardedStore() *vmap {
+// newShardedStore returns a vmap with n shards, n must be a power of 2
+func newShardedStore(n int) *vmap {
 	ss := &vmap{
-		bucket: make(map[int]*shard, maxBucket),
+		bucket: make([]*shard, n),
+		mask:   uint64(n - 1),
 	}
-	for i := 0; i < maxBucket; i++ {
+	for i := 0; i < n; i++ {
 		ss.bucket[i] = &shard{m: make(map[uint64]uint64)}
 	}
 	return ss
 }
 
 
-func bucketIdx(key uint64) int {
-	return int(key & uint64(maxBucket-1))
+func (v *vmap) shardOf(key uint64) *shard {
+	return v.bucket[key&v.mask]
 }
 
 func (v *vmap) store(key uint64, value uint64) {
-	index := bucketIdx(key)
-	if silo, ok := v.bucket[index]; ok {
-		silo.m[key] = value
-	}
+	silo := v.shardOf(key)
+	silo.Lock()
+	silo.m[key] = value
+	silo.Unlock()
 }
 
 
 func (v *vmap) load(key uint64) (uint64, bool) {
-	index := bucketIdx(key)
-	if silo, ok := v.bucket[index]; ok {
-		val, ok := silo.m[key]
-		return val, ok
+	silo := v.shardOf(key)
+	silo.RLock()
+	val, ok := silo.m[key]
+	silo.RUnlock()
+	return val, ok
+}
+
+// locked returns the shard of the key locked for writing
+func (v *vmap) locked(key uint64) *shard {
+	silo := v.shardOf(key)
+	silo.Lock()
+	return silo
+}
+
+// rlocked returns the shard of the key read locked, the value of the key can't change till it's unlocked
+func (v *vmap) rlocked(key uint64) *shard {
+	silo := v.shardOf(key)
+	silo.RLock()
+	return silo
+}
+
+// iterate calls fn for every key and its position till fn returns false. The entries of each shard are
+// copied out before fn is called for them, so fn may access the vmap
+func (v *vmap) iterate(fn func(key uint64, value uint64) bool) {
+	var entries []uint64
+	for _, silo := range v.bucket {
+		silo.RLock()
+		entries = entries[:0]
+		for k, val := range silo.m {
+			entries = append(entries, k, val)
+		}
+		silo.RUnlock()
+		for i := 0; i < len(entries); i += 2 {
+			if !fn(entries[i], entries[i+1]) {
+				return
+			}
+		}
 	}
-	return 0, false
 }
 
 func (v *vmap) loadAndDelete(key uint64) (uint64, bool) {
-	index := bucketIdx(key)
-	if silo, ok := v.bucket[index]; ok {
-		val, ok := silo.m[key]
-		if ok {
-			delete(silo.m, key)
-		}
-		return val, ok
+	silo := v.shardOf(key)
+	silo.Lock()
+	val, ok := silo.m[key]
+	if ok {
+		delete(silo.m, key)
 	}
-	return 0, false
+	silo.Unlock()
+	return val, ok
 }
@@ -0,0 +1,49 @@
+package gravity
+
+import (
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+)
+
+func TestVmap_Parallel(t *testing.T) {
+	v := newShardedStore(8)
+	var wg sync.WaitGroup
+	for w := uint64(0); w < 8; w++ {
+		wg.Add(1)
+		go func(w uint64) {
+			defer wg.Done()
+			for k := w * 1000; k < w*1000+1000; k++ {
+				v.store(k, k*2)
+				val, ok := v.load(k)
+				require.True(t, ok)
+				require.Equal(t, k*2, val)
+				if k%2 == 0 {
+					_, ok = v.loadAndDelete(k)
+					require.True(t, ok)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	count := 0
+	v.iterate(func(key uint64, value uint64) bool {
+		require.Equal(t, uint64(1), key%2)
+		require.Equal(t, key*2, value)
+		count++
+		return true
+	})
+	require.Equal(t, 4000, count)
+}
+
+func TestVmap_Shards(t *testing.T) {
+	for n, want := range map[int]int{0: 1, 1: 1, 3: 4, 32: 32, 33: 64} {
+		g, err := NewGravity(make([]byte, 128), WithIndexShards(n))
+		require.NoError(t, err)
+		require.Equal(t, want, len(g.vmap.bucket))
+	}
+	g, err := NewGravity(make([]byte, 128))
+	require.NoError(t, err)
+	require.Equal(t, maxBucket, len(g.vmap.bucket))
+}